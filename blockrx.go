@@ -5,16 +5,10 @@
 package dcom
 
 import (
-	"container/list"
 	"github.com/jdhxyy/crc16"
 	"sync"
-	"time"
 )
 
-// tBlockRecvFunc 块传输接收函数类型
-// 注意载荷实际长度不是frame载荷长度字段
-type tBlockRecvFunc func(protocol int, pipe uint64, srcIA uint64, frame *tFrame)
-
 type tBlockRxItem struct {
 	protocol    int
 	pipe        uint64
@@ -24,184 +18,290 @@ type tBlockRxItem struct {
 	// 上次发送时间
 	lastTxTime int64
 	retryNums  int
-}
+	// 本次重发间隔.单位:us
+	retryInterval int64
+	// 是否已经为当前缺失的帧发送过BACK
+	isGapBacked bool
+	// 乱序缓存.按偏移地址保存超前到达的帧载荷
+	pending map[int][]uint8
+	// 是否已接收完成.完成后保留一段时间,迟到的帧回复最终的BACK,不再复位
+	isDone bool
 
-var blockRxItems list.List
-var blockRxItemsMutex sync.Mutex
+	key   tBlockKey
+	timer *tTimer
+}
 
-var blockRecv tBlockRecvFunc
+// tBlockRxShard 块传输接收队列分片
+type tBlockRxShard struct {
+	items map[tBlockKey]*tBlockRxItem
+	mutex sync.Mutex
+}
 
-// gThreadBlockRxRun 块传输接收模块运行线程
-func gThreadBlockRxRun() {
-	for {
-		blockRxItemsMutex.Lock()
-		sendAllBackFrame()
-		blockRxItemsMutex.Unlock()
+// tBlockRxTable 块传输接收队列.按会话关键字索引
+type tBlockRxTable struct {
+	shards [gShardNum]tBlockRxShard
+}
 
-		time.Sleep(gInterval)
+func (t *tBlockRxTable) init() {
+	for i := range t.shards {
+		t.shards[i].items = make(map[tBlockKey]*tBlockRxItem)
 	}
 }
 
-func sendAllBackFrame() {
-	now := gGetTime()
-	interval := int64(gParam.BlockRetryInterval) * 1000
-
-	node := blockRxItems.Front()
-	var nodeNext *list.Element
-	var item *tBlockRxItem
-	for {
-		if node == nil {
-			break
-		}
-		nodeNext = node.Next()
-
-		for {
-			item = node.Value.(*tBlockRxItem)
-			if now-item.lastTxTime < interval {
-				break
-			}
-			if item.retryNums > gParam.BlockRetryMaxNum {
-				logWarn("block rx send back retry num too many!token:%d", item.frame.controlWord.token)
-				blockRxItems.Remove(node)
-				break
-			}
-			// 超时重发
-			if gParam.IsAllowSend(item.pipe) == false {
-				break
-			}
-			logWarn("block rx send back retry num:%d token:%d", item.retryNums, item.frame.controlWord.token)
-			sendBackFrame(item)
-			break
-		}
+func (t *tBlockRxTable) shard(key *tExchangeKey) *tBlockRxShard {
+	return &t.shards[shardIndex(key)]
+}
 
-		node = nodeNext
+// blockRxItemTimeout 节点定时器到期处理.超时重发BACK帧
+func (e *Endpoint) blockRxItemTimeout(item *tBlockRxItem) {
+	sh := e.blockRxItems.shard(&item.key.tExchangeKey)
+	sh.mutex.Lock()
+	if sh.items[item.key] != item {
+		sh.mutex.Unlock()
+		return
+	}
+	if item.isDone {
+		e.blockRxItemsRemove(sh, item)
+		sh.mutex.Unlock()
+		return
 	}
+	param := e.getParam()
+	if item.retryNums > param.BlockRetryMaxNum {
+		logWarn("block rx send back retry num too many!token:%d", item.frame.controlWord.token)
+		e.blockRxItemsRemove(sh, item)
+		sh.mutex.Unlock()
+		return
+	}
+	// 超时重发
+	if e.pipeAllowSend(item.pipe) == false {
+		e.scheduler.schedule(item.timer, e.getTime()+item.retryInterval)
+		sh.mutex.Unlock()
+		return
+	}
+	logWarn("block rx send back retry num:%d token:%d", item.retryNums, item.frame.controlWord.token)
+	frame := e.blockRxBuildBackFrame(item)
+	sh.mutex.Unlock()
+
+	e.send(item.protocol, item.pipe, item.srcIA, frame)
 }
 
-func sendBackFrame(item *tBlockRxItem) {
+// blockRxBuildBackFrame 构建BACK帧并调度下一次重发.调用者需持有分片锁,在锁外发送
+func (e *Endpoint) blockRxBuildBackFrame(item *tBlockRxItem) *tFrame {
+	frame := blockRxNewBackFrame(item)
+	item.retryNums++
+	item.lastTxTime = e.getTime()
+	item.retryInterval = e.retryInterval(item.pipe, item.srcIA, item.retryNums-1)
+	e.scheduler.schedule(item.timer, item.lastTxTime+item.retryInterval)
+	return frame
+}
+
+// blockRxNewBackFrame 构建确认当前偏移地址的BACK帧
+// 有乱序缓存时在偏移地址后附加选择确认范围.只有窗口发送方会产生乱序帧,停等传输的对端不会收到扩展的BACK
+func blockRxNewBackFrame(item *tBlockRxItem) *tFrame {
 	logInfo("block rx send back frame.token:%d offset:%d", item.frame.controlWord.token, item.blockHeader.offset)
 	var frame tFrame
 	frame.controlWord.code = gCodeBack
 	frame.controlWord.blockFlag = 0
 	frame.controlWord.rid = item.frame.controlWord.rid
 	frame.controlWord.token = item.frame.controlWord.token
-	frame.controlWord.payloadLen = 2
-	frame.payload = make([]uint8, 2)
-	frame.payload[0] = uint8(item.blockHeader.offset >> 8)
-	frame.payload[1] = uint8(item.blockHeader.offset)
-	gSend(item.protocol, item.pipe, item.srcIA, &frame)
-
-	item.retryNums++
-	item.lastTxTime = gGetTime()
+	frame.payload = gBackToBytes(item.blockHeader.offset, sackRanges(item.pending), item.blockHeader.isExt)
+	frame.controlWord.payloadLen = len(frame.payload)
+	return &frame
 }
 
-// gBlockRxSetCallback 设置接收回调函数
-func gBlockRxSetCallback(recvFunc tBlockRecvFunc) {
-	blockRecv = recvFunc
+// blockRxItemsRemove 从块传输接收队列删除节点并取消定时器.调用者需持有分片锁
+func (e *Endpoint) blockRxItemsRemove(sh *tBlockRxShard, item *tBlockRxItem) {
+	delete(sh.items, item.key)
+	e.scheduler.cancel(item.timer)
 }
 
-// gBlockRxReceive 块传输接收数据
-func gBlockRxReceive(protocol int, pipe uint64, srcIA uint64, frame *tBlockFrame) {
-	blockRxItemsMutex.Lock()
-	defer blockRxItemsMutex.Unlock()
-
-	logInfo("block rx receive.token:%d src_ia:0x%x", frame.controlWord.token, srcIA)
-	node := getNodeBlockRxItems(protocol, pipe, srcIA, frame)
-	if node == nil {
-		createAndAppendNodeBlockRxItems(protocol, pipe, srcIA, frame)
-	} else {
-		editNodeBlockRxItems(protocol, pipe, node, frame)
+// shutdownBlockRxItems 清空块传输接收队列
+func (e *Endpoint) shutdownBlockRxItems() {
+	for i := range e.blockRxItems.shards {
+		sh := &e.blockRxItems.shards[i]
+		sh.mutex.Lock()
+		for _, item := range sh.items {
+			e.blockRxItemsRemove(sh, item)
+		}
+		sh.mutex.Unlock()
 	}
 }
 
-func getNodeBlockRxItems(protocol int, pipe uint64, srcIA uint64, frame *tBlockFrame) *list.Element {
-	node := blockRxItems.Front()
-	var item *tBlockRxItem
-
-	for {
-		if node == nil {
-			break
-		}
-		item = node.Value.(*tBlockRxItem)
-		if item.protocol == protocol && item.pipe == pipe && item.srcIA == srcIA &&
-			item.frame.controlWord.token == frame.controlWord.token &&
-			item.frame.controlWord.rid == frame.controlWord.rid &&
-			item.frame.controlWord.code == frame.controlWord.code {
-			return node
+// blockRxReceive 块传输接收数据
+// 应答帧和接收完成的数据在锁外处理,避免处理函数中发送数据时死锁
+func (e *Endpoint) blockRxReceive(protocol int, pipe uint64, srcIA uint64, frame *tBlockFrame) {
+	logInfo("block rx receive.token:%d src_ia:0x%x", frame.controlWord.token, srcIA)
+	key := tBlockKey{tExchangeKey: tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA,
+		rid: frame.controlWord.rid, token: frame.controlWord.token}, code: frame.controlWord.code}
+	sh := e.blockRxItems.shard(&key.tExchangeKey)
+	sh.mutex.Lock()
+	item, ok := sh.items[key]
+	if ok && item.isDone {
+		if frame.blockHeader.offset != 0 && item.blockHeader.crc16 == frame.blockHeader.crc16 &&
+			item.blockHeader.total == frame.blockHeader.total {
+			// 已完成的块传输迟到的帧
+			backFrame := blockRxNewBackFrame(item)
+			sh.mutex.Unlock()
+			e.send(protocol, pipe, srcIA, backFrame)
+			return
 		}
-		node = node.Next()
+		// 首帧是token复用后新的块传输
+		e.blockRxItemsRemove(sh, item)
+		ok = false
 	}
-	return nil
-}
+	if ok == false {
+		if frame.blockHeader.offset != 0 {
+			sh.mutex.Unlock()
+			logWarn("block rx create and append item failed!offset is not 0:%d.token:%d send rst",
+				frame.blockHeader.offset, frame.controlWord.token)
+			e.sendRstFrame(protocol, pipe, srcIA, SystemErrorWrongBlockOffset, frame.controlWord.rid,
+				frame.controlWord.token)
+			return
+		}
+		item = e.blockRxCreateItem(sh, &key, frame)
+		backFrame := e.blockRxBuildBackFrame(item)
+		sh.mutex.Unlock()
 
-func createAndAppendNodeBlockRxItems(protocol int, pipe uint64, srcIA uint64, frame *tBlockFrame) {
-	if frame.blockHeader.offset != 0 {
-		logWarn("block rx create and append item failed!offset is not 0:%d.token:%d send rst",
-			frame.blockHeader.offset, frame.controlWord.token)
-		gSendRstFrame(protocol, pipe, srcIA, SystemErrorWrongBlockOffset, frame.controlWord.rid,
-			frame.controlWord.token)
+		e.send(protocol, pipe, srcIA, backFrame)
 		return
 	}
 
+	backFrame, isEnd := e.blockRxEditItem(sh, item, frame)
+	sh.mutex.Unlock()
+
+	if backFrame != nil {
+		e.send(protocol, pipe, srcIA, backFrame)
+	}
+	if isEnd {
+		e.dealRecv(item.protocol, item.pipe, item.srcIA, &item.frame)
+	}
+}
+
+// blockRxCreateItem 创建节点并加入接收队列.调用者需持有分片锁
+func (e *Endpoint) blockRxCreateItem(sh *tBlockRxShard, key *tBlockKey, frame *tBlockFrame) *tBlockRxItem {
 	var item tBlockRxItem
-	item.pipe = pipe
-	item.srcIA = srcIA
+	item.protocol = key.protocol
+	item.pipe = key.pipe
+	item.srcIA = key.ia
+	item.key = *key
 	item.frame.controlWord = frame.controlWord
 	item.blockHeader = frame.blockHeader
 	item.frame.payload = append(item.frame.payload, frame.payload...)
 	item.blockHeader.offset = len(frame.payload)
-	blockRxItems.PushBack(&item)
-	sendBackFrame(&item)
+	item.timer = newTimer(0, func() {
+		e.blockRxItemTimeout(&item)
+	})
+	sh.items[*key] = &item
+	return &item
 }
 
-func editNodeBlockRxItems(protocol int, pipe uint64, node *list.Element, frame *tBlockFrame) {
-	item := node.Value.(*tBlockRxItem)
-	if item.blockHeader.offset != frame.blockHeader.offset || item.protocol != protocol || item.pipe != pipe {
-		logWarn("block rx edit item failed!token:%d.item<->frame:offset:%d %d,protocol:%d %d,pipe:%d %d",
-			frame.controlWord.token, item.blockHeader.offset, frame.blockHeader.offset, item.protocol, protocol,
-			item.pipe, pipe)
-		return
+// blockRxEditItem 接收后续帧
+// 返回需要发送的BACK帧和是否接收完成.调用者需持有分片锁
+func (e *Endpoint) blockRxEditItem(sh *tBlockRxShard, item *tBlockRxItem, frame *tBlockFrame) (*tFrame, bool) {
+	if item.blockHeader.isExt != frame.blockHeader.isExt || item.blockHeader.total != frame.blockHeader.total {
+		logWarn("block rx edit item failed!token:%d.block header is not match", frame.controlWord.token)
+		return nil, false
+	}
+	if item.blockHeader.offset != frame.blockHeader.offset {
+		if frame.blockHeader.offset < item.blockHeader.offset {
+			logWarn("block rx edit item failed!token:%d.item<->frame:offset:%d %d", frame.controlWord.token,
+				item.blockHeader.offset, frame.blockHeader.offset)
+			return nil, false
+		}
+		if _, ok := item.pending[frame.blockHeader.offset]; ok {
+			// 重复的乱序帧
+			return nil, false
+		}
+		// 窗口传输中前面的帧丢失或者乱序.缓存后立即确认,发送方根据选择确认范围重发缺失的帧
+		if e.blockRxSavePending(item, frame) {
+			return blockRxNewBackFrame(item), false
+		}
+		if item.isGapBacked == false {
+			item.isGapBacked = true
+			return blockRxNewBackFrame(item), false
+		}
+		return nil, false
 	}
 
+	item.isGapBacked = false
 	item.frame.payload = append(item.frame.payload, frame.payload...)
 	item.blockHeader.offset += len(frame.payload)
+	blockRxDrainPending(item)
 
 	item.retryNums = 0
-	sendBackFrame(item)
-
-	if item.blockHeader.offset >= item.blockHeader.total {
-		logInfo("block rx receive end.token:%d", item.frame.controlWord.token)
-		crcCalc := crc16.Checksum(item.frame.payload)
-		if crcCalc != item.blockHeader.crc16 {
-			logWarn("block rx crc is wrong.token:%d crc calc:0x%x get:0x%x", item.frame.controlWord.token, crcCalc,
-				item.blockHeader.crc16)
-			blockRxItems.Remove(node)
-			return
-		}
-		if blockRecv != nil {
-			blockRecv(item.protocol, item.pipe, item.srcIA, &item.frame)
-		}
-		blockRxItems.Remove(node)
+	backFrame := e.blockRxBuildBackFrame(item)
+
+	if item.blockHeader.offset < item.blockHeader.total {
+		return backFrame, false
 	}
+	logInfo("block rx receive end.token:%d", item.frame.controlWord.token)
+	crcCalc := crc16.Checksum(item.frame.payload)
+	if crcCalc != item.blockHeader.crc16 {
+		logWarn("block rx crc is wrong.token:%d crc calc:0x%x get:0x%x", item.frame.controlWord.token, crcCalc,
+			item.blockHeader.crc16)
+		e.blockRxItemsRemove(sh, item)
+		return backFrame, false
+	}
+	// 保留到发送方不再重发
+	item.isDone = true
+	param := e.getParam()
+	e.scheduler.schedule(item.timer, e.getTime()+int64(param.BlockRetryInterval)*1000*int64(param.BlockRetryMaxNum))
+	return backFrame, true
 }
 
-// gBlockRxDealRstFrame 块传输接收模块处理复位连接帧
-func gBlockRxDealRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
-	node := blockRxItems.Front()
-	var item *tBlockRxItem
+// blockRxSavePending 缓存超前到达的帧.超出总字节数或者缓存已满时返回false.调用者需持有分片锁
+func (e *Endpoint) blockRxSavePending(item *tBlockRxItem, frame *tBlockFrame) bool {
+	limit := e.getParam().BlockReorderFrames
+	if limit == 0 {
+		limit = gBlockReorderFramesDefault
+	}
+	if limit < 0 || len(item.pending) >= limit {
+		return false
+	}
+	if frame.blockHeader.offset+len(frame.payload) > item.blockHeader.total {
+		return false
+	}
+	if item.pending == nil {
+		item.pending = make(map[int][]uint8)
+	}
+	logInfo("block rx save pending.token:%d offset:%d", frame.controlWord.token, frame.blockHeader.offset)
+	item.pending[frame.blockHeader.offset] = append([]uint8(nil), frame.payload...)
+	return true
+}
 
+// blockRxDrainPending 把乱序缓存中与已接收数据连续的帧拼接到数据后面.调用者需持有分片锁
+func blockRxDrainPending(item *tBlockRxItem) {
 	for {
-		if node == nil {
+		payload, ok := item.pending[item.blockHeader.offset]
+		if ok == false {
 			break
 		}
-		item = node.Value.(*tBlockRxItem)
-		if item.protocol == protocol && item.pipe == pipe && item.srcIA == srcIA &&
-			item.frame.controlWord.token == frame.controlWord.token &&
-			item.frame.controlWord.rid == frame.controlWord.rid {
+		delete(item.pending, item.blockHeader.offset)
+		item.frame.payload = append(item.frame.payload, payload...)
+		item.blockHeader.offset += len(payload)
+	}
+	// 帧长度变化时缓存的帧可能与已接收数据重叠,丢弃后由发送方重发
+	for offset := range item.pending {
+		if offset < item.blockHeader.offset {
+			delete(item.pending, offset)
+		}
+	}
+}
+
+// blockRxDealRstFrame 块传输接收模块处理复位连接帧
+func (e *Endpoint) blockRxDealRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	sh := e.blockRxItems.shard(&key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	for _, code := range blockCodes {
+		item, ok := sh.items[tBlockKey{tExchangeKey: key, code: code}]
+		if ok {
 			logWarn("block rx rst.token:%d", item.frame.controlWord.token)
-			blockRxItems.Remove(node)
+			e.blockRxItemsRemove(sh, item)
 			return
 		}
-		node = node.Next()
 	}
 }
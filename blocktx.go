@@ -5,12 +5,14 @@
 package dcom
 
 import (
-	"container/list"
+	"errors"
 	"github.com/jdhxyy/crc16"
 	"sync"
-	"time"
 )
 
+// errBlockExtNotSupported 对端不支持扩展块传输
+var errBlockExtNotSupported = errors.New("dcom: peer does not support block transfer over 65535 bytes")
+
 type tBlockTxItem struct {
 	protocol int
 	pipe     uint64
@@ -20,131 +22,405 @@ type tBlockTxItem struct {
 	token    int
 
 	// 第一帧需要重发控制
-	isFirstFrame        bool
-	firstFrameRetryTime int64
-	firstFrameRetryNum  int
+	isFirstFrame            bool
+	firstFrameRetryTime     int64
+	firstFrameRetryNum      int
+	firstFrameRetryInterval int64
 
 	lastRxAckTime int64
 
+	// 发送窗口.单位:帧.为1时是停等传输
+	window int
+	// 对端确认的偏移地址.之前的数据对端已全部接收
+	ackOffset int
+	// 下一个待发送帧的偏移地址
+	nextOffset int
+	// 已发送数据的结束偏移地址
+	sentOffset int
+	// 对端选择确认的帧.按帧偏移地址索引
+	sacked map[int]bool
+	// 此偏移地址之前缺失的帧已经重发过
+	recoverOffset int
+
+	// 测量往返时间的帧.重发过的帧不测量,偏移地址为-1表示没有测量
+	rttOffset int
+	rttTime   int64
+
 	crc16 uint16
 	data  []uint8
+	// 是否使用扩展头部
+	isExt bool
+	// 每帧数据最大字节数.不包括块传输头部
+	payloadMax int
+
+	opts *tCallOptions
+
+	key   tBlockKey
+	timer *tTimer
 }
 
-var blockTxItems list.List
-var blockTxItemsMutex sync.Mutex
+// tBlockTxShard 块传输发送队列分片
+type tBlockTxShard struct {
+	items map[tBlockKey]*tBlockTxItem
+	mutex sync.Mutex
+}
 
-// gThreadBlockTxRun 块传输发送模块运行线程
-func gThreadBlockTxRun() {
-	for {
-		blockTxItemsMutex.Lock()
+// tBlockTxTable 块传输发送队列.按会话关键字索引
+type tBlockTxTable struct {
+	shards [gShardNum]tBlockTxShard
+}
 
-		node := blockTxItems.Front()
-		var nextNode *list.Element
-		for {
-			if node == nil {
-				break
-			}
-			nextNode = node.Next()
-			checkTimeoutAndRetrySendFirstFrame(node)
-			node = nextNode
+func (t *tBlockTxTable) init() {
+	for i := range t.shards {
+		t.shards[i].items = make(map[tBlockKey]*tBlockTxItem)
+	}
+}
+
+func (t *tBlockTxTable) shard(key *tExchangeKey) *tBlockTxShard {
+	return &t.shards[shardIndex(key)]
+}
+
+// len 节点数
+func (t *tBlockTxTable) len() int {
+	num := 0
+	for i := range t.shards {
+		t.shards[i].mutex.Lock()
+		num += len(t.shards[i].items)
+		t.shards[i].mutex.Unlock()
+	}
+	return num
+}
+
+// find 查找会话对应的节点.BACK和RST帧不区分code,依次查找.调用者需持有分片锁
+func (sh *tBlockTxShard) find(key *tExchangeKey) *tBlockTxItem {
+	for _, code := range blockCodes {
+		if item, ok := sh.items[tBlockKey{tExchangeKey: *key, code: code}]; ok {
+			return item
 		}
+	}
+	return nil
+}
+
+// blockTxSchedule 调度节点的下一次检查
+// 首帧检查重发,非首帧检查接收BACK超时
+func (e *Endpoint) blockTxSchedule(item *tBlockTxItem) {
+	if item.isFirstFrame {
+		e.scheduler.schedule(item.timer, item.firstFrameRetryTime+item.firstFrameRetryInterval)
+		return
+	}
+	e.scheduler.schedule(item.timer, item.lastRxAckTime+e.blockTxTimeout(item))
+}
 
-		blockTxItemsMutex.Unlock()
+// blockTxTimeout 非首帧接收BACK超时时间.单位:us
+func (e *Endpoint) blockTxTimeout(item *tBlockTxItem) int64 {
+	interval := item.opts.retryInterval
+	if interval == 0 {
+		interval = int64(e.getParam().BlockRetryInterval) * 1000
+	}
+	return interval * int64(item.opts.retryMaxNum)
+}
+
+// blockTxItemTimeout 节点定时器到期处理
+func (e *Endpoint) blockTxItemTimeout(item *tBlockTxItem) {
+	sh := e.blockTxItems.shard(&item.key.tExchangeKey)
+	sh.mutex.Lock()
+	if sh.items[item.key] != item {
+		sh.mutex.Unlock()
+		return
+	}
+	frame := e.checkTimeoutAndRetrySendFirstFrame(sh, item)
+	isRemoved := sh.items[item.key] != item
+	isSent := item.sentOffset >= len(item.data)
+	if isRemoved == false {
+		e.blockTxSchedule(item)
+	}
+	sh.mutex.Unlock()
+
+	if isRemoved {
+		if item.code != gCodeCon {
+			return
+		}
+		if isSent {
+			// 数据已全部发送过,可能只是最后的BACK丢失
+			e.waitItemBlockSent(&item.key.tExchangeKey, e.blockTxTimeout(item))
+		} else {
+			// 对端不可能接收完整,调用不会再收到应答
+			e.failWaitItem(&item.key.tExchangeKey, SystemErrorRxTimeout, nil)
+		}
+		return
+	}
+	if frame != nil {
+		e.blockTxDealSendError(item, e.blockSend(item.protocol, item.pipe, item.dstIA, frame, item.opts.priority))
+	}
+}
 
-		time.Sleep(gInterval)
+// blockTxDealSendError 处理块传输发送错误
+// 临时错误由重传机制处理.其他错误结束块传输,请求的块传输同时结束调用
+func (e *Endpoint) blockTxDealSendError(item *tBlockTxItem, err error) {
+	if err == nil || isTemporary(err) {
+		return
+	}
+	logWarn("block tx send failed:%v.remove task.token:%d", err, item.token)
+	e.blockRemove(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token)
+	if item.code == gCodeCon {
+		e.failWaitItem(&item.key.tExchangeKey, SystemErrorSendFailed, err)
 	}
 }
 
 // checkTimeoutAndRetrySendFirstFrame 检查超时节点和重发首帧
-func checkTimeoutAndRetrySendFirstFrame(node *list.Element) {
-	item := node.Value.(*tBlockTxItem)
-	now := gGetTime()
+// 返回需要重发的首帧.调用者需持有分片锁,在锁外发送
+func (e *Endpoint) checkTimeoutAndRetrySendFirstFrame(sh *tBlockTxShard, item *tBlockTxItem) *tBlockFrame {
+	now := e.getTime()
 	if item.isFirstFrame == false {
 		// 非首帧
-		if now-item.lastRxAckTime > int64(gParam.BlockRetryInterval*gParam.BlockRetryMaxNum*1000) {
+		if now-item.lastRxAckTime >= e.blockTxTimeout(item) {
 			logWarn("block tx timeout!remove task.token:%d", item.token)
-			blockTxItems.Remove(node)
+			e.blockTxItemsRemove(sh, item)
 		}
-		return
+		return nil
 	}
 
 	// 首帧处理
-	if now-item.firstFrameRetryTime < int64(gParam.BlockRetryInterval*1000) {
-		return
+	if now-item.firstFrameRetryTime < item.firstFrameRetryInterval {
+		return nil
 	}
 
-	if item.firstFrameRetryNum >= gParam.BlockRetryMaxNum {
+	if item.firstFrameRetryNum >= item.opts.retryMaxNum {
 		logWarn("block tx timeout!first frame send retry too many.token:%d", item.token)
-		blockTxItems.Remove(node)
-	} else {
-		item.firstFrameRetryNum++
-		item.firstFrameRetryTime = now
-		logInfo("block tx send first frame.token:%d retry num:%d", item.token, item.firstFrameRetryNum)
-		blockTxSendFrame(item, 0)
+		e.blockTxItemsRemove(sh, item)
+		return nil
 	}
+	item.firstFrameRetryNum++
+	item.firstFrameRetryTime = now
+	item.firstFrameRetryInterval = e.optionRetryInterval(item.opts, item.pipe, item.dstIA, item.firstFrameRetryNum)
+	logInfo("block tx send first frame.token:%d retry num:%d", item.token, item.firstFrameRetryNum)
+	item.rttOffset = -1
+	return e.blockTxBuildFrame(item, 0)
 }
 
-func blockTxSendFrame(item *tBlockTxItem, offset int) {
-	logInfo("block tx send.token:%d offset:%d", item.token, offset)
-	delta := len(item.data) - offset
-	payloadLen := gSingleFrameSizeMax - gBlockHeaderLen
-	if payloadLen > delta {
-		payloadLen = delta
+// SetBlockWindow 设置默认端点管道的块传输发送窗口
+func SetBlockWindow(pipe uint64, window int) {
+	defaultEndpoint.SetBlockWindow(pipe, window)
+}
+
+// SetBlockWindow 设置管道的块传输发送窗口.单位:帧.小于等于0时使用LoadParam.BlockWindow
+func (e *Endpoint) SetBlockWindow(pipe uint64, window int) {
+	e.pipesMutex.Lock()
+	defer e.pipesMutex.Unlock()
+	if window <= 0 {
+		delete(e.blockWindows, pipe)
+		return
+	}
+	e.blockWindows[pipe] = window
+}
+
+// blockWindow 读取管道的块传输发送窗口.单位:帧
+func (e *Endpoint) blockWindow(pipe uint64) int {
+	e.pipesMutex.RLock()
+	window, ok := e.blockWindows[pipe]
+	e.pipesMutex.RUnlock()
+	if ok {
+		return window
+	}
+	window = e.getParam().BlockWindow
+	if window <= 0 {
+		return 1
+	}
+	return window
+}
+
+// blockTxIsSizeValid 块传输数据长度是否有效
+// 超过65535字节使用扩展头部,管道单帧需要能容纳扩展头部和至少1个字节数据
+func (e *Endpoint) blockTxIsSizeValid(pipe uint64, size int) bool {
+	if int64(size) > gBlockDataMax {
+		return false
+	}
+	if size > gBlockDataMaxLegacy && e.frameSizeMax(pipe) <= gBlockHeaderExtLen {
+		return false
+	}
+	return true
+}
+
+// blockTxIsExtFirstFrame 会话的扩展块传输是否还在发送首帧
+func (e *Endpoint) blockTxIsExtFirstFrame(key *tExchangeKey) bool {
+	sh := e.blockTxItems.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	item := sh.find(key)
+	return item != nil && item.isExt && item.isFirstFrame
+}
+
+// blockTxFillWindow 从nextOffset开始发送新帧直到窗口填满或者数据发送完
+// 返回需要发送的帧.调用者需持有分片锁,在锁外发送
+func (e *Endpoint) blockTxFillWindow(item *tBlockTxItem) []*tBlockFrame {
+	var frames []*tBlockFrame
+	payloadLen := item.payloadMax
+	// 对端已缓存的帧不占用窗口
+	for item.nextOffset < len(item.data) && item.nextOffset < item.ackOffset+(item.window+len(item.sacked))*payloadLen {
+		if item.sacked[item.nextOffset] {
+			item.nextOffset += blockTxFrameLen(item, item.nextOffset)
+			continue
+		}
+		if item.rttOffset < 0 && item.nextOffset >= item.sentOffset {
+			item.rttOffset = item.nextOffset
+			item.rttTime = e.getTime()
+		}
+		frame := e.blockTxBuildFrame(item, item.nextOffset)
+		frames = append(frames, frame)
+		item.nextOffset += len(frame.payload)
+		if item.sentOffset < item.nextOffset {
+			item.sentOffset = item.nextOffset
+		}
+	}
+	return frames
+}
+
+// blockTxMarkSacked 记录选择确认范围内完整的帧.返回是否有新确认的帧.调用者需持有分片锁
+func blockTxMarkSacked(item *tBlockTxItem, ranges []tSackRange) bool {
+	isNew := false
+	payloadLen := item.payloadMax
+	for _, r := range ranges {
+		offset := (r.start + payloadLen - 1) / payloadLen * payloadLen
+		for offset < len(item.data) && offset+blockTxFrameLen(item, offset) <= r.end {
+			if offset >= item.ackOffset && item.sacked[offset] == false {
+				if item.sacked == nil {
+					item.sacked = make(map[int]bool)
+				}
+				item.sacked[offset] = true
+				isNew = true
+			}
+			offset += payloadLen
+		}
 	}
+	return isNew
+}
+
+// blockTxRetransmitHoles 重发选择确认范围之间缺失的帧.每个缺失的帧在一轮恢复中只重发一次
+// 返回需要发送的帧.调用者需持有分片锁,在锁外发送
+func (e *Endpoint) blockTxRetransmitHoles(item *tBlockTxItem, ranges []tSackRange) []*tBlockFrame {
+	highest := 0
+	for _, r := range ranges {
+		if highest < r.end {
+			highest = r.end
+		}
+	}
+	var frames []*tBlockFrame
+	payloadLen := item.payloadMax
+	for offset := item.recoverOffset; offset < highest && offset < item.nextOffset; offset += payloadLen {
+		if item.sacked[offset] == false {
+			logInfo("block tx retransmit hole.token:%d offset:%d", item.token, offset)
+			frames = append(frames, e.blockTxBuildFrame(item, offset))
+			item.rttOffset = -1
+		}
+	}
+	if item.recoverOffset < highest {
+		item.recoverOffset = highest
+	}
+	return frames
+}
+
+// blockTxFrameLen 从offset开始的帧载荷字节数
+func blockTxFrameLen(item *tBlockTxItem, offset int) int {
+	payloadLen := item.payloadMax
+	if payloadLen > len(item.data)-offset {
+		return len(item.data) - offset
+	}
+	return payloadLen
+}
+
+// blockTxBuildFrame 构建从offset开始的块传输帧.调用者需持有分片锁
+func (e *Endpoint) blockTxBuildFrame(item *tBlockTxItem, offset int) *tBlockFrame {
+	logInfo("block tx send.token:%d offset:%d", item.token, offset)
+	payloadLen := blockTxFrameLen(item, offset)
 
 	var frame tBlockFrame
 	frame.controlWord.code = item.code
 	frame.controlWord.blockFlag = 1
 	frame.controlWord.rid = item.rid
 	frame.controlWord.token = item.token
-	frame.controlWord.payloadLen = gBlockHeaderLen + payloadLen
 	frame.blockHeader.crc16 = item.crc16
 	frame.blockHeader.total = len(item.data)
 	frame.blockHeader.offset = offset
+	frame.blockHeader.isExt = item.isExt
+	frame.controlWord.payloadLen = gBlockHeaderLenOf(&frame.blockHeader) + payloadLen
 	frame.payload = append(frame.payload, item.data[offset:offset+payloadLen]...)
-	gBlockSend(item.protocol, item.pipe, item.dstIA, &frame)
+	return &frame
 }
 
-// gBlockTx 块传输发送
-func gBlockTx(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int, data []uint8) {
-	if len(data) <= gSingleFrameSizeMax {
-		return
+// blockTx 块传输发送.返回首帧的发送错误,非临时错误时块传输已结束
+// opts为nil时使用载入参数.请求(CON和NON)的token引用由调用者持有,节点删除时释放
+func (e *Endpoint) blockTx(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int, data []uint8,
+	opts *tCallOptions) error {
+	frameSize := e.frameSizeMax(pipe)
+	if len(data) <= frameSize {
+		return nil
+	}
+	if e.blockTxIsSizeValid(pipe, len(data)) == false {
+		logWarn("block tx failed!data len is invalid:%d.token:%d", len(data), token)
+		return ErrParamInvalid
 	}
 
-	blockTxItemsMutex.Lock()
-	defer blockTxItemsMutex.Unlock()
-
-	if blockTxIsNodeExist(protocol, pipe, dstIA, code, rid, token) {
-		return
+	key := tBlockKey{tExchangeKey: tExchangeKey{protocol: protocol, pipe: pipe, ia: dstIA, rid: rid, token: token},
+		code: code}
+	sh := e.blockTxItems.shard(&key.tExchangeKey)
+	sh.mutex.Lock()
+	if _, ok := sh.items[key]; ok {
+		sh.mutex.Unlock()
+		if code != gCodeAck {
+			e.releaseToken(pipe, dstIA, token)
+		}
+		return nil
 	}
 
 	logInfo("block tx new task.token:%d dst ia:0x%x code:%d rid:%d", token, dstIA, code, rid)
-	item := blockTxCreateItem(protocol, pipe, dstIA, code, rid, token, data)
-	blockTxSendFrame(item, 0)
+	if opts == nil {
+		param := e.getParam()
+		opts = newCallOptions(&param, nil)
+	}
+	item := e.blockTxCreateItem(protocol, pipe, dstIA, code, rid, token, data)
+	item.key = key
+	item.isExt = len(data) > gBlockDataMaxLegacy
+	item.payloadMax = frameSize - gBlockHeaderLen
+	if item.isExt {
+		item.payloadMax = frameSize - gBlockHeaderExtLen
+	}
+	item.opts = opts
+	item.timer = newTimer(opts.priority, func() {
+		e.blockTxItemTimeout(item)
+	})
+	// 首帧建立对端的接收任务,收到首帧的BACK后才按窗口发送
+	item.window = e.blockWindow(pipe)
+	item.rttOffset = 0
+	item.rttTime = e.getTime()
+	frame := e.blockTxBuildFrame(item, 0)
+	item.sentOffset = len(frame.payload)
 	item.firstFrameRetryNum++
-	item.firstFrameRetryTime = gGetTime()
-	blockTxItems.PushBack(item)
+	item.firstFrameRetryTime = e.getTime()
+	item.firstFrameRetryInterval = e.optionRetryInterval(opts, pipe, dstIA, 0)
+	sh.items[key] = item
+	e.blockTxSchedule(item)
+	sh.mutex.Unlock()
+
+	err := e.blockSend(protocol, pipe, dstIA, frame, opts.priority)
+	if err != nil && isTemporary(err) == false {
+		logWarn("block tx send first frame failed:%v.remove task.token:%d", err, token)
+		e.blockRemove(protocol, pipe, dstIA, code, rid, token)
+	}
+	return err
 }
 
-func blockTxIsNodeExist(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int) bool {
-	node := blockTxItems.Front()
-	var item *tBlockTxItem
-	for {
-		if node == nil {
-			break
-		}
-		item = node.Value.(*tBlockTxItem)
-
-		if item.protocol == protocol && item.pipe == pipe && item.dstIA == dstIA && item.code == code &&
-			item.rid == rid && item.token == token {
-			return true
-		}
-		node = node.Next()
+// blockTxItemsRemove 从块传输发送队列删除节点并取消定时器.调用者需持有分片锁
+// 应答的token由对端分配,只有请求需要释放token
+func (e *Endpoint) blockTxItemsRemove(sh *tBlockTxShard, item *tBlockTxItem) {
+	delete(sh.items, item.key)
+	e.scheduler.cancel(item.timer)
+	if item.code != gCodeAck {
+		e.releaseToken(item.pipe, item.dstIA, item.token)
 	}
-	return false
 }
 
-func blockTxCreateItem(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int, data []uint8) *tBlockTxItem {
+func (e *Endpoint) blockTxCreateItem(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int,
+	data []uint8) *tBlockTxItem {
 	var item tBlockTxItem
 	item.protocol = protocol
 	item.pipe = pipe
@@ -157,111 +433,149 @@ func blockTxCreateItem(protocol int, pipe uint64, dstIA uint64, code int, rid in
 
 	item.isFirstFrame = true
 	item.firstFrameRetryNum = 0
-	now := gGetTime()
+	now := e.getTime()
 	item.firstFrameRetryTime = now
 	item.lastRxAckTime = now
+	item.rttOffset = -1
 	return &item
 }
 
-// gBlockRxBackFrame 接收到BACK帧时处理函数
-func gBlockRxBackFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
+// blockRxBackFrame 接收到BACK帧时处理函数
+func (e *Endpoint) blockRxBackFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 	if frame.controlWord.code != gCodeBack {
 		return
 	}
 
-	blockTxItemsMutex.Lock()
-	defer blockTxItemsMutex.Unlock()
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	sh := e.blockTxItems.shard(&key)
+	sh.mutex.Lock()
+	item := sh.find(&key)
+	if item == nil {
+		sh.mutex.Unlock()
+		return
+	}
+	txFrames := e.dealBackFrame(sh, item, frame)
+	isDone := sh.items[item.key] != item
+	sh.mutex.Unlock()
 
-	node := blockTxItems.Front()
-	var nextNode *list.Element
-	for {
-		if node == nil {
-			break
+	if isDone {
+		if item.code == gCodeCon {
+			e.waitItemBlockSent(&item.key.tExchangeKey, e.blockTxTimeout(item))
 		}
-		nextNode = node.Next()
-		if checkNodeAndDealBackFrame(protocol, pipe, srcIA, frame, node) {
-			break
+		return
+	}
+
+	for _, txFrame := range txFrames {
+		err := e.blockSend(item.protocol, item.pipe, item.dstIA, txFrame, item.opts.priority)
+		if err != nil && isTemporary(err) == false {
+			e.blockTxDealSendError(item, err)
+			return
 		}
-		node = nextNode
 	}
 }
 
-// checkNodeAndDealBackFrame 检查节点是否符合条件,符合则处理BACK帧
-// 返回true表示节点符合条件
-func checkNodeAndDealBackFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame, node *list.Element) bool {
-	item := node.Value.(*tBlockTxItem)
-
-	if item.protocol != protocol || item.pipe != pipe || item.dstIA != srcIA || item.rid != frame.controlWord.rid ||
-		item.token != frame.controlWord.token {
-		return false
-	}
+// dealBackFrame 处理BACK帧
+// BACK中的偏移地址是对端下一个期望接收的偏移地址,之后可能附加选择确认范围.确认有进展时滑动窗口发送新帧,
+// 选择确认范围之间缺失的帧立即重发.没有新信息的重复确认表示重发的帧或者之后的帧丢失,从确认的偏移地址重发.
+// 返回需要发送的帧.调用者需持有分片锁,在锁外发送
+func (e *Endpoint) dealBackFrame(sh *tBlockTxShard, item *tBlockTxItem, frame *tFrame) []*tBlockFrame {
 	logInfo("block tx receive back.token:%d", item.token)
-	if frame.controlWord.payloadLen != 2 {
+	startOffset, ranges, ok := gBytesToBack(frame.payload, item.isExt)
+	if ok == false {
 		logWarn("block rx receive back deal failed!token:%d payload len is wrong:%d", item.token,
 			frame.controlWord.payloadLen)
-		return false
+		return nil
+	}
+	if item.rttOffset >= 0 && startOffset > item.rttOffset {
+		e.rttSample(item.pipe, item.dstIA, e.getTime()-item.rttTime)
+		item.rttOffset = -1
 	}
-	startOffset := (int(frame.payload[0]) << 8) + int(frame.payload[1])
 	if startOffset >= len(item.data) {
 		// 发送完成
 		logInfo("block tx end.receive back token:%d start offset:%d >= data len:%d", item.token, startOffset,
 			len(item.data))
-		blockTxItems.Remove(node)
-		return true
+		e.blockTxItemsRemove(sh, item)
+		return nil
 	}
 
+	if item.isFirstFrame == false && startOffset < item.ackOffset {
+		// 过期的确认
+		return nil
+	}
+	isNewSack := blockTxMarkSacked(item, ranges)
+	if item.isFirstFrame == false && startOffset == item.ackOffset && isNewSack == false {
+		// 重复的确认.回退重发,重发的帧不测量往返时间
+		logInfo("block tx receive duplicate back.token:%d go back to offset:%d", item.token, startOffset)
+		item.recoverOffset = startOffset
+		if len(ranges) == 0 {
+			// 对端没有缓存乱序帧
+			item.nextOffset = startOffset
+			item.sacked = nil
+		}
+		item.rttOffset = -1
+	}
 	if item.isFirstFrame {
 		item.isFirstFrame = false
 	}
-	item.lastRxAckTime = gGetTime()
-
-	blockTxSendFrame(item, startOffset)
-	return true
+	item.ackOffset = startOffset
+	for offset := range item.sacked {
+		if offset < startOffset {
+			delete(item.sacked, offset)
+		}
+	}
+	if item.nextOffset < startOffset {
+		item.nextOffset = startOffset
+	}
+	if item.recoverOffset < startOffset {
+		item.recoverOffset = startOffset
+	}
+	item.lastRxAckTime = e.getTime()
+	e.blockTxSchedule(item)
+	frames := e.blockTxRetransmitHoles(item, ranges)
+	return append(frames, e.blockTxFillWindow(item)...)
 }
 
-// gBlockTxDealRstFrame 块传输发送模块处理复位连接帧
-func gBlockTxDealRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
-	blockTxItemsMutex.Lock()
-	defer blockTxItemsMutex.Unlock()
+// blockTxDealRstFrame 块传输发送模块处理复位连接帧
+func (e *Endpoint) blockTxDealRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	sh := e.blockTxItems.shard(&key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
 
-	node := blockTxItems.Front()
-	var item *tBlockTxItem
-	for {
-		if node == nil {
-			break
-		}
+	item := sh.find(&key)
+	if item == nil {
+		return
+	}
+	logWarn("block tx receive rst.token:%d", item.token)
+	e.blockTxItemsRemove(sh, item)
+}
 
-		item = node.Value.(*tBlockTxItem)
-		if item.protocol == protocol && item.pipe == pipe && item.dstIA == srcIA && item.rid == frame.controlWord.rid &&
-			item.token == frame.controlWord.token {
-			logWarn("block tx receive rst.token:%d", item.token)
-			blockTxItems.Remove(node)
-			return
+// shutdownBlockTxItems 清空块传输发送队列
+func (e *Endpoint) shutdownBlockTxItems() {
+	for i := range e.blockTxItems.shards {
+		sh := &e.blockTxItems.shards[i]
+		sh.mutex.Lock()
+		for _, item := range sh.items {
+			e.blockTxItemsRemove(sh, item)
 		}
-
-		node = node.Next()
+		sh.mutex.Unlock()
 	}
 }
 
-// gBlockRemove 块传输发送移除任务
-func gBlockRemove(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int) {
-	blockTxItemsMutex.Lock()
-	defer blockTxItemsMutex.Unlock()
+// blockRemove 块传输发送移除任务
+func (e *Endpoint) blockRemove(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int) {
+	key := tBlockKey{tExchangeKey: tExchangeKey{protocol: protocol, pipe: pipe, ia: dstIA, rid: rid, token: token},
+		code: code}
+	sh := e.blockTxItems.shard(&key.tExchangeKey)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
 
-	node := blockTxItems.Front()
-	var item *tBlockTxItem
-	for {
-		if node == nil {
-			break
-		}
-		item = node.Value.(*tBlockTxItem)
-
-		if item.protocol == protocol && item.pipe == pipe && item.dstIA == dstIA && item.code == code &&
-			item.rid == rid && item.token == token {
-			logWarn("block tx remove task.token:%d", item.token)
-			blockTxItems.Remove(node)
-			break
-		}
-		node = node.Next()
+	item, ok := sh.items[key]
+	if ok == false {
+		return
 	}
+	logWarn("block tx remove task.token:%d", item.token)
+	e.blockTxItemsRemove(sh, item)
 }
@@ -4,27 +4,173 @@
 
 package dcom
 
+import (
+	"context"
+	"time"
+)
+
 // CallbackFunc 注册DCOM服务回调函数
 // 返回值是应答和错误码.错误码为0表示回调成功,否则是错误码
 type CallbackFunc func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int)
 
-var services = make(map[int]CallbackFunc)
+// HandlerFunc 注册DCOM服务处理函数
+// 通过w写入应答或者错误码.函数返回后框架发送应答.调用w.Defer后框架不再应答,由服务通过Responder应答
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// Request 服务请求
+type Request struct {
+	ctx context.Context
+
+	Protocol int
+	Pipe     uint64
+	SrcIA    uint64
+	Rid      int
+	Token    int
+	// 是否是CON帧.否则是NON帧,不需要应答
+	IsCon bool
+	// 是否通过块传输接收
+	IsBlock bool
+	// 接收时间
+	Time    time.Time
+	Payload []uint8
+}
+
+// Context 请求的上下文
+// 端点关闭或者处理结束时取消,延迟应答时处理结束指Responder应答或者超时.LoadParam.HandlerTimeout非0时带有截止时间
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// ResponseWriter 服务应答
+type ResponseWriter interface {
+	// Write 写入应答数据.多次写入会追加
+	Write(data []uint8)
+	// WriteError 写入错误码.错误码非SystemOK时对端收到复位连接帧
+	WriteError(code int)
+	// Defer 延迟应答.服务处理函数返回后框架不发送应答,由服务稍后通过Responder完成应答.
+	// NON帧不需要应答,返回的Responder应答时不发送数据
+	Defer() *Responder
+}
+
+type tResponseWriter struct {
+	e         *Endpoint
+	key       tExchangeKey
+	isCon     bool
+	data      []uint8
+	code      int
+	responder *Responder
+	// 取消请求的上下文.延迟应答时交给Responder
+	cancel context.CancelFunc
+}
+
+func (w *tResponseWriter) Write(data []uint8) {
+	w.data = append(w.data, data...)
+}
+
+func (w *tResponseWriter) WriteError(code int) {
+	w.code = code
+}
+
+func (w *tResponseWriter) Defer() *Responder {
+	if w.responder != nil {
+		return w.responder
+	}
+	if w.isCon {
+		w.responder = w.e.deferResponse(w.key, w.cancel)
+	} else {
+		w.responder = &Responder{e: w.e, key: w.key, isNon: true, cancel: w.cancel}
+	}
+	return w.responder
+}
 
 // Register 注册服务回调函数
 func Register(protocol int, rid int, callback CallbackFunc) {
+	defaultEndpoint.Register(protocol, rid, callback)
+}
+
+// RegisterHandler 注册服务处理函数
+func RegisterHandler(protocol int, rid int, handler HandlerFunc) {
+	defaultEndpoint.RegisterHandler(protocol, rid, handler)
+}
+
+// Register 注册服务回调函数
+func (e *Endpoint) Register(protocol int, rid int, callback CallbackFunc) {
+	e.RegisterHandler(protocol, rid, func(w ResponseWriter, req *Request) {
+		resp, err := callback(req.Pipe, req.SrcIA, req.Payload)
+		w.Write(resp)
+		w.WriteError(err)
+	})
+}
+
+// RegisterHandler 注册服务处理函数
+// 同一个处理函数可以注册到多个rid,通过req.Rid区分
+func (e *Endpoint) RegisterHandler(protocol int, rid int, handler HandlerFunc) {
 	logInfo("register.protocol:%d rid:%d", protocol, rid)
 	rid += protocol << 16
-	services[rid] = callback
+
+	e.servicesMutex.Lock()
+	e.services[rid] = handler
+	e.servicesMutex.Unlock()
 }
 
-// gCallback 回调资源号rid对应的函数
-func gCallback(protocol int, pipe uint64, srcIA uint64, rid int, req []uint8) ([]uint8, int) {
+// callback 回调资源号rid对应的函数
+// 返回值中保存应答数据,错误码以及是否延迟应答
+func (e *Endpoint) callback(protocol int, pipe uint64, srcIA uint64, frame *tFrame) *tResponseWriter {
+	rid := frame.controlWord.rid
 	logInfo("service callback.rid:%d", rid)
-	rid += protocol << 16
-	v, ok := services[rid]
+
+	var w tResponseWriter
+	w.e = e
+	w.key = tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: rid, token: frame.controlWord.token}
+	w.isCon = frame.controlWord.code == gCodeCon
+
+	e.servicesMutex.RLock()
+	v, ok := e.services[rid+protocol<<16]
+	e.servicesMutex.RUnlock()
 	if ok == false {
 		logWarn("service callback failed!can not find new rid:%d", rid)
-		return nil, SystemErrorInvalidRid
+		w.code = SystemErrorInvalidRid
+		return &w
+	}
+
+	var req Request
+	req.Protocol = protocol
+	req.Pipe = pipe
+	req.SrcIA = srcIA
+	req.Rid = rid
+	req.Token = frame.controlWord.token
+	req.IsCon = frame.controlWord.code == gCodeCon
+	req.IsBlock = frame.controlWord.blockFlag == 1
+	req.Time = e.getClock().Now()
+	req.Payload = frame.payload
+
+	// 延迟应答时上下文在应答完成后取消
+	ctx, cancel := e.handlerContext()
+	req.ctx = ctx
+	w.cancel = cancel
+
+	v(&w, &req)
+	if w.responder == nil {
+		cancel()
+	}
+	return &w
+}
+
+// handlerContext 创建服务处理函数的上下文
+func (e *Endpoint) handlerContext() (context.Context, context.CancelFunc) {
+	e.mutex.RLock()
+	ctx := e.ctx
+	timeout := e.param.HandlerTimeout
+	e.mutex.RUnlock()
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout > 0 {
+		return withClockTimeout(ctx, e.getClock(), time.Duration(timeout)*time.Millisecond)
 	}
-	return v(pipe, srcIA, req)
+	return context.WithCancel(ctx)
 }
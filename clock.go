@@ -0,0 +1,119 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 时钟模块.端点的当前时间和定时器都从时钟获取,测试时可以替换为手动推进的时钟
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock 时钟
+type Clock interface {
+	// Now 当前时间
+	Now() time.Time
+	// NewTimer 创建定时器.经过d后向通道发送当前时间
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer 定时器
+type ClockTimer interface {
+	// C 到期通道
+	C() <-chan time.Time
+	// Stop 停止定时器.定时器已到期或者已停止时返回false
+	Stop() bool
+	// Reset 重新设置定时器在d后到期.定时器在运行中时返回true
+	Reset(d time.Duration) bool
+}
+
+// tSystemClock 系统时钟
+type tSystemClock struct{}
+
+// tSystemTimer 系统定时器
+type tSystemTimer struct {
+	timer *time.Timer
+}
+
+// gSystemClock 系统时钟.没有设置时钟时使用
+var gSystemClock Clock = tSystemClock{}
+
+func (tSystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (tSystemClock) NewTimer(d time.Duration) ClockTimer {
+	return &tSystemTimer{timer: time.NewTimer(d)}
+}
+
+func (t *tSystemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *tSystemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+func (t *tSystemTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+// getClock 读取端点时钟
+func (e *Endpoint) getClock() Clock {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.clock
+}
+
+// getTime 获取当前时间.单位:us
+func (e *Endpoint) getTime() int64 {
+	return e.getClock().Now().UnixNano() / 1000
+}
+
+// tClockContext 在时钟上超时的上下文.系统时间和时钟不一致时按时钟判断截止时间
+type tClockContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+	err      error
+	mutex    sync.Mutex
+}
+
+// withClockTimeout 创建经过timeout后在时钟上超时的上下文.到期后Err返回context.DeadlineExceeded
+func withClockTimeout(parent context.Context, clock Clock, timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+	inner, cancel := context.WithCancel(parent)
+	ctx := &tClockContext{Context: inner, deadline: clock.Now().Add(timeout), done: make(chan struct{})}
+	timer := clock.NewTimer(timeout)
+	go func() {
+		var err error
+		select {
+		case <-timer.C():
+			err = context.DeadlineExceeded
+		case <-inner.Done():
+			timer.Stop()
+			err = inner.Err()
+		}
+		ctx.mutex.Lock()
+		ctx.err = err
+		ctx.mutex.Unlock()
+		close(ctx.done)
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func (c *tClockContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *tClockContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *tClockContext) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
@@ -5,22 +5,10 @@
 package dcom
 
 import (
+	"encoding/binary"
 	"net"
-	"time"
 )
 
-var tokenValue = 0
-
-// gGetToken 获取token
-// token范围:0-1023
-func gGetToken() int {
-	tokenValue++
-	if tokenValue > 1023 {
-		tokenValue = 0
-	}
-	return tokenValue
-}
-
 // gControlWordToBytes 控制字转换为字节流.字节流是大端顺序
 func gControlWordToBytes(word *tControlWord) []uint8 {
 	var value uint32
@@ -74,7 +62,19 @@ func gBytesToFrame(bytes []uint8) *tFrame {
 }
 
 // gBlockHeaderToBytes 块传输头部转换为字节流
+// 扩展头部的16位总字节数和偏移地址是扩展标志,后面是32位的总字节数和偏移地址
 func gBlockHeaderToBytes(header *tBlocHeader) []uint8 {
+	if header.isExt {
+		bytes := make([]uint8, 0, gBlockHeaderExtLen)
+		bytes = append(bytes, uint8(header.crc16>>8), uint8(header.crc16), 0, 0, uint8(gBlockExtMarker>>8),
+			uint8(gBlockExtMarker&0xff))
+		bytes = append(bytes, uint8(header.total>>24), uint8(header.total>>16), uint8(header.total>>8),
+			uint8(header.total))
+		bytes = append(bytes, uint8(header.offset>>24), uint8(header.offset>>16), uint8(header.offset>>8),
+			uint8(header.offset))
+		return bytes
+	}
+
 	bytes := make([]uint8, 6)
 	j := 0
 	bytes[j] = uint8(header.crc16 >> 8)
@@ -92,6 +92,14 @@ func gBlockHeaderToBytes(header *tBlocHeader) []uint8 {
 	return bytes
 }
 
+// gBlockHeaderLenOf 块传输头部字节数
+func gBlockHeaderLenOf(header *tBlocHeader) int {
+	if header.isExt {
+		return gBlockHeaderExtLen
+	}
+	return gBlockHeaderLen
+}
+
 // gBytesToBlockHeader 字节流转块传输头部
 func gBytesToBlockHeader(bytes []uint8) *tBlocHeader {
 	if len(bytes) < gBlockHeaderLen {
@@ -105,6 +113,19 @@ func gBytesToBlockHeader(bytes []uint8) *tBlocHeader {
 	j += 2
 	header.offset = (int(bytes[j]) << 8) + int(bytes[j+1])
 	j += 2
+	if header.total != 0 || header.offset != gBlockExtMarker {
+		return &header
+	}
+
+	// 扩展头部
+	if len(bytes) < gBlockHeaderExtLen {
+		return nil
+	}
+	header.isExt = true
+	header.total = int(binary.BigEndian.Uint32(bytes[j:]))
+	j += 4
+	header.offset = int(binary.BigEndian.Uint32(bytes[j:]))
+	j += 4
 	return &header
 }
 
@@ -128,7 +149,7 @@ func gByetsToBlockFrame(bytes []uint8) *tBlockFrame {
 		return nil
 	}
 
-	var blockHeader = gBytesToBlockHeader(bytes[gControlWordLen:])
+	var blockHeader = gBytesToBlockHeader(bytes[gControlWordLen : gControlWordLen+word.payloadLen])
 	if blockHeader == nil {
 		return nil
 	}
@@ -136,23 +157,46 @@ func gByetsToBlockFrame(bytes []uint8) *tBlockFrame {
 	var frame tBlockFrame
 	frame.controlWord = *word
 	frame.blockHeader = *blockHeader
-	frame.payload = append(frame.payload, bytes[gControlWordLen+gBlockHeaderLen:gControlWordLen+word.payloadLen]...)
+	headerLen := gBlockHeaderLenOf(blockHeader)
+	frame.payload = append(frame.payload, bytes[gControlWordLen+headerLen:gControlWordLen+word.payloadLen]...)
 	return &frame
 }
 
-// gGetTime 获取当前时间.单位:us
-func gGetTime() int64 {
-	return time.Now().UnixNano() / 1000
+// IsFrame 字节流是否是一个完整的DCOM帧
+// 传输层可以在为新的对端分配资源之前用它过滤无效数据
+func IsFrame(bytes []uint8) bool {
+	word := gBytesToControlWord(bytes)
+	if word == nil || word.code > gCodeBack || len(bytes) != gControlWordLen+word.payloadLen {
+		return false
+	}
+	if word.blockFlag == 1 {
+		return gByetsToBlockFrame(bytes) != nil
+	}
+	return true
 }
 
 // AddrToPipe 网络地址转换为管道号
-// 转换规则为网络端口+ip地址.大端排列
+// 转换规则为网络端口+ip地址.大端排列.只支持IPv4
+// 其他地址无法编码,返回0并记录警告,但0也是有效的管道号.地址可能不是IPv4时使用UDPAddrToPipe或者PipeTable
 func AddrToPipe(addr *net.UDPAddr) uint64 {
+	pipe, ok := UDPAddrToPipe(addr)
+	if ok == false {
+		logWarn("addr to pipe failed!not ipv4 addr:%v", addr)
+	}
+	return pipe
+}
+
+// UDPAddrToPipe 网络地址转换为管道号.转换规则同AddrToPipe
+// 不是IPv4地址时返回false,IPv6等地址需使用PipeTable分配管道号
+func UDPAddrToPipe(addr *net.UDPAddr) (uint64, bool) {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return 0, false
+	}
 	var pipe uint64
-	pipe = (uint64(addr.IP.To4()[0]) << 24) + (uint64(addr.IP.To4()[1]) << 16) + (uint64(addr.IP.To4()[2]) << 8) +
-		uint64(addr.IP.To4()[3])
+	pipe = (uint64(ip[0]) << 24) + (uint64(ip[1]) << 16) + (uint64(ip[2]) << 8) + uint64(ip[3])
 	pipe |= (((uint64(addr.Port) >> 8) & 0xff) << 40) + (((uint64(addr.Port)) & 0xff) << 32)
-	return pipe
+	return pipe, true
 }
 
 // PipeToAddr 管道号转换为网络地址
@@ -7,6 +7,7 @@ package dcom
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
 )
 
 // 对外参数
@@ -32,6 +33,16 @@ const (
 	SystemErrorWrongBlockOffset = 0x15
 	// 参数错误
 	SystemErrorParamInvalid = 0x16
+	// 端点已关闭.本地错误码
+	SystemErrorShutdown = 0x17
+	// 调用被取消
+	SystemErrorCanceled = 0x18
+	// 与对端的token已全部占用.本地错误码
+	SystemErrorTokenExhausted = 0x19
+	// 发送失败.本地错误码
+	SystemErrorSendFailed = 0x1a
+	// 管道已关闭.本地错误码
+	SystemErrorPipeClosed = 0x1b
 )
 
 // 模块内参数
@@ -50,9 +61,20 @@ const (
 	gControlWordLen = 4
 	// 块传输头部长度
 	gBlockHeaderLen = 6
-
-	// 运行间隔.单位:us.子模块运行函数执行间隔
-	gInterval = 100000
+	// 扩展块传输头部长度.数据超过65535字节时使用,总字节数和偏移地址是32位
+	gBlockHeaderExtLen = 14
+	// 扩展块传输头部标志.16位总字节数为0,16位偏移地址为此值.不支持扩展的对端收到首帧时回复偏移地址错误
+	gBlockExtMarker = 0xffff
+	// 块传输最大字节数
+	gBlockDataMax = int64(0xffffffff)
+	// 不使用扩展头部的块传输最大字节数
+	gBlockDataMaxLegacy = 0xffff
+
+	// token最大值
+	gTokenMax = 1023
+
+	// 最大时间.单位:us.用于表示没有截止时间
+	gTimeMax = math.MaxInt64
 )
 
 // tControlWord 控制字
@@ -75,6 +97,8 @@ type tBlocHeader struct {
 	crc16  uint16
 	total  int
 	offset int
+	// 是否是扩展头部
+	isExt bool
 }
 
 // tBlockFrame 块传输帧.重定义了dcom帧的载荷
@@ -91,32 +115,67 @@ type IsAllowSendFuncByPipeFunc func(pipe uint64) bool
 // SendByPipeFunc 向指定端口发送函数类型
 type SendByPipeFunc func(protocol int, pipe uint64, dstIA uint64, bytes []uint8)
 
+// SendWithErrorByPipeFunc 向指定端口发送函数类型.返回发送错误
+// 错误实现Temporary() bool并返回true时是临时错误,调用计为一次重传.其他错误使调用立即失败
+type SendWithErrorByPipeFunc func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) error
+
 // LoadParam 载入参数
 type LoadParam struct {
 	// 块传输帧重试间隔.单位:ms
 	BlockRetryInterval int
 	// 块传输帧重试最大次数
 	BlockRetryMaxNum int
-
-	// API接口
-	// 是否允许发送
+	// 块传输发送窗口.单位:帧.收到首帧的确认后同时发送的帧数,为0或者1时是停等传输.
+	// 只影响发送方,对端按顺序接收,可以与停等传输的对端互通.管道可以用SetBlockWindow单独设置
+	BlockWindow int
+	// 块传输接收乱序缓存的最大帧数.为0时使用默认值32,小于0时不缓存乱序帧
+	BlockReorderFrames int
+	// 调用被ctx取消时是否向对端发送复位连接帧.对端收到后停止处理该调用,包括停止块传输发送应答
+	IsSendRstOnCancel bool
+	// 服务处理函数超时时间.单位:ms.非0时请求的上下文带有截止时间,按端点时钟计时
+	HandlerTimeout int
+	// 延迟应答超时时间.单位:ms.超时后向对端发送复位连接帧.为0时使用BlockRetryInterval*BlockRetryMaxNum/2
+	DeferTimeout int
+	// 应答缓存上限.单位:字节.非0时开启重复请求检测,重传的CON帧直接重放缓存的应答,不再调用服务
+	DedupCacheSize int
+	// 会话生存时间.单位:ms.应答在缓存中保存的时间.为0时使用BlockRetryInterval*BlockRetryMaxNum
+	ExchangeLifetime int
+	// 是否开启自适应重传.开启后按管道和对端地址测量往返时间计算重传超时,重传时指数退避并加入随机抖动.
+	// 没有测量值时使用BlockRetryInterval
+	IsAdaptiveRetry bool
+	// 重传超时下限和上限.单位:ms.为0时使用默认值10ms和60s
+	RtoMin int
+	RtoMax int
+
+	// 在途调用上限.分别限制全局,每个管道和每个对端同时进行的调用数.为0表示不限制
+	// 只统计本端发起的调用,调用的块传输发送计入调用本身
+	// 服务端应答的块传输不计入:应答由对端的调用触发,数量已受对端在途限制约束,限制应答还会阻塞服务处理函数
+	MaxInflight        int
+	MaxInflightPerPipe int
+	MaxInflightPerPeer int
+	// 超过上限时的处理策略.默认阻塞调用者
+	InflightPolicy int
+
+	// 每个管道发送队列最大帧数.为0表示不使用发送队列,管道不允许发送时丢弃帧.
+	// 使用发送队列时管道不允许发送的帧缓存在队列中,调用NotifyPipeReady后按顺序发送.队列满时丢弃最低优先级中最早的帧
+	OutboundQueueSize int
+
+	// 时钟.为nil时使用系统时钟.重传,超时和块传输的定时都使用此时钟.只在端点启动时读取,运行中重复载入不会更换
+	Clock Clock
+
+	// API接口.没有通过AddPipe注册的管道使用这两个接口发送,可以为nil
+	// 是否允许发送.为nil时允许发送
 	IsAllowSend IsAllowSendFuncByPipeFunc
 	// 发送的是DCOM协议数据
 	Send SendByPipeFunc
+	// 返回发送错误的发送接口.不为nil时代替Send使用
+	SendWithError SendWithErrorByPipeFunc
 }
 
-var gParam LoadParam
-
 // Load 模块载入
+// 载入默认端点.重复载入只更新参数,不会重复启动运行线程
 func Load(param *LoadParam) {
-	gParam = *param
-
-	// 模块载入
-	gRxLoad()
-
-	// 模块运行
-	go gThreadBlockRxRun()
-	go gThreadBlockTxRun()
+	defaultEndpoint.load(param)
 }
 
 // StructToBytes 结构体转字节流
@@ -1,9 +1,18 @@
 package dcom
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/exec"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/jdhxyy/crc16"
 )
 
 func TestCase1(t *testing.T) {
@@ -119,3 +128,1376 @@ func TestCase8(t *testing.T) {
 	fmt.Printf("0x%x\n", pipe)
 	fmt.Println(PipeToAddr(pipe))
 }
+
+func testNewEndpointPair() (*Endpoint, *Endpoint) {
+	var a, b *Endpoint
+	var paramA, paramB LoadParam
+	paramA.BlockRetryMaxNum = 5
+	paramA.BlockRetryInterval = 100
+	paramA.IsAllowSend = testIsAllowSend
+	paramA.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		go b.Receive(protocol, pipe, 0x1, bytes)
+	}
+	paramB = paramA
+	paramB.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		go a.Receive(protocol, pipe, 0x2, bytes)
+	}
+	a = NewEndpoint(&paramA)
+	b = NewEndpoint(&paramB)
+	return a, b
+}
+
+func TestEndpoint(t *testing.T) {
+	a, b := testNewEndpointPair()
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return append([]uint8{0xa5}, req...), SystemOK
+	})
+
+	resp, err := a.Call(0, 1, 0x2, 1, 3000, []uint8{1, 2, 3})
+	if err != SystemOK || len(resp) != 4 || resp[0] != 0xa5 {
+		t.Fatal("call failed", err, resp)
+	}
+
+	arr := make([]uint8, 1000)
+	for i := range arr {
+		arr[i] = uint8(i)
+	}
+	resp, err = a.Call(0, 1, 0x2, 1, 3000, arr)
+	if err != SystemOK || len(resp) != 1001 || resp[1000] != arr[999] {
+		t.Fatal("block call failed", err, len(resp))
+	}
+
+	_, err = a.Call(0, 1, 0x2, 2, 3000, arr[:10])
+	if err != SystemErrorInvalidRid {
+		t.Fatal("call invalid rid should fail", err)
+	}
+}
+
+func TestInvoke(t *testing.T) {
+	a, _ := testNewEndpointPair()
+	_, err := a.Invoke(0, 1, 0x2, 2, 3000, []uint8{1})
+	if errors.Is(err, ErrInvalidRid) == false {
+		t.Fatal("invoke invalid rid should fail", err)
+	}
+	var dcomErr *Error
+	if errors.As(err, &dcomErr) == false || dcomErr.IsRemote == false || dcomErr.Rid != 2 || dcomErr.IA != 0x2 {
+		t.Fatal("wrong error detail", err)
+	}
+	fmt.Println(err)
+}
+
+func TestClose(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {}
+	e := NewEndpoint(&param)
+
+	resp := e.CallAsync(0, 1, 0x1234, 1, 3000, []uint8{1})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := e.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatal("close should hit deadline", err)
+	}
+	<-resp.Done
+	if resp.Error != SystemErrorShutdown {
+		t.Fatal("pending call should fail with shutdown", resp.Error)
+	}
+
+	_, err := e.Call(0, 1, 0x1234, 1, 3000, []uint8{1})
+	if err != SystemErrorShutdown {
+		t.Fatal("call after close should fail", err)
+	}
+	if err := e.Close(context.Background()); err != nil {
+		t.Fatal("close twice should succeed", err)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	rst := make(chan []uint8, 10)
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsSendRstOnCancel = true
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		if bytes[0]>>5 == gCodeRst {
+			rst <- bytes
+		}
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := e.CallContext(ctx, 0, 1, 0x1234, 1, make([]uint8, 600))
+	if err != SystemErrorCanceled {
+		t.Fatal("call should be canceled", err)
+	}
+	select {
+	case frame := <-rst:
+		if frame[4] != SystemErrorCanceled|0x80 {
+			t.Fatal("wrong rst frame", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rst frame not sent")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = e.CallContext(ctx, 0, 1, 0x1234, 1, []uint8{1})
+	if err != SystemErrorRxTimeout {
+		t.Fatal("call should time out", err)
+	}
+
+	// 没有截止时间的块传输请求在首帧重传用尽后结束
+	_, err = e.CallContext(context.Background(), 0, 1, 0x1234, 1, make([]uint8, 1000), WithRetries(3),
+		WithRetryInterval(20*time.Millisecond))
+	if err != SystemErrorRxTimeout || e.waitItems.len() != 0 || e.blockTxItems.len() != 0 {
+		t.Fatal("block call without deadline should time out", err, e.waitItems.len(), e.blockTxItems.len())
+	}
+
+	// 块传输发送完成后应答丢失
+	var a, b *Endpoint
+	paramA := param
+	paramA.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		go b.Receive(protocol, pipe, 0x1, bytes)
+	}
+	paramB := param
+	paramB.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		if bytes[0]>>5 != gCodeAck {
+			go a.Receive(protocol, pipe, 0x2, bytes)
+		}
+	}
+	a = NewEndpoint(&paramA)
+	b = NewEndpoint(&paramB)
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return []uint8{1}, SystemOK
+	})
+	_, err = a.CallContext(context.Background(), 0, 1, 0x2, 1, make([]uint8, 1000), WithRetries(3),
+		WithRetryInterval(20*time.Millisecond))
+	if err != SystemErrorRxTimeout || a.waitItems.len() != 0 {
+		t.Fatal("block call without response should time out", err, a.waitItems.len())
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	a, b := testNewEndpointPair()
+	for rid := 10; rid < 13; rid++ {
+		b.RegisterHandler(0, rid, func(w ResponseWriter, req *Request) {
+			if req.Context() == nil || req.IsCon == false || req.SrcIA != 0x1 {
+				w.WriteError(SystemErrorParamInvalid)
+				return
+			}
+			w.Write([]uint8{uint8(req.Rid)})
+			if req.IsBlock {
+				w.Write([]uint8{1})
+			}
+		})
+	}
+
+	resp, err := a.Call(0, 1, 0x2, 11, 3000, []uint8{1})
+	if err != SystemOK || len(resp) != 1 || resp[0] != 11 {
+		t.Fatal("call handler failed", err, resp)
+	}
+	resp, err = a.Call(0, 1, 0x2, 12, 3000, make([]uint8, 300))
+	if err != SystemOK || len(resp) != 2 || resp[0] != 12 {
+		t.Fatal("call handler by block failed", err, resp)
+	}
+}
+
+func TestDeferResponse(t *testing.T) {
+	a, b := testNewEndpointPair()
+	param := b.getParam()
+	param.DeferTimeout = 200
+	b.load(&param)
+	ctxs := make(chan context.Context, 1)
+	b.RegisterHandler(0, 1, func(w ResponseWriter, req *Request) {
+		r := w.Defer()
+		go func() {
+			time.Sleep(150 * time.Millisecond)
+			if req.Context().Err() != nil {
+				t.Error("request context should live until response", req.Context().Err())
+			}
+			r.Ack(make([]uint8, 400))
+			ctxs <- req.Context()
+			if r.Ack(nil) == nil {
+				t.Error("ack twice should fail")
+			}
+		}()
+	})
+	b.RegisterHandler(0, 2, func(w ResponseWriter, req *Request) {
+		w.Defer()
+	})
+
+	// 延迟期间对端重传不会再次调用服务
+	resp, err := a.Call(0, 1, 0x2, 1, 3000, []uint8{1})
+	if err != SystemOK || len(resp) != 400 {
+		t.Fatal("defer response failed", err, len(resp))
+	}
+	if ctx := <-ctxs; ctx.Err() != context.Canceled {
+		t.Fatal("request context should be canceled after response", ctx.Err())
+	}
+	_, err = a.Call(0, 1, 0x2, 2, 3000, []uint8{1})
+	if err != SystemErrorTxTimeout {
+		t.Fatal("defer response should time out", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	var a, b *Endpoint
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	param.DedupCacheSize = 4096
+	param.IsAllowSend = testIsAllowSend
+	paramA := param
+	paramA.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		go b.Receive(protocol, pipe, 0x1, bytes)
+		go b.Receive(protocol, pipe, 0x1, bytes)
+	}
+	var mutex sync.Mutex
+	dropNum := 0
+	paramB := param
+	paramB.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		// 丢弃第一个应答
+		mutex.Lock()
+		dropNum++
+		isDrop := dropNum == 1
+		mutex.Unlock()
+		if isDrop {
+			return
+		}
+		go a.Receive(protocol, pipe, 0x2, bytes)
+	}
+	a = NewEndpoint(&paramA)
+	b = NewEndpoint(&paramB)
+
+	toggleNum := 0
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		toggleNum++
+		return []uint8{uint8(toggleNum)}, SystemOK
+	})
+
+	resp, err := a.Call(0, 1, 0x2, 1, 3000, []uint8{1})
+	if err != SystemOK || resp[0] != 1 {
+		t.Fatal("call failed", err, resp)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if toggleNum != 1 {
+		t.Fatal("service called more than once", toggleNum)
+	}
+}
+
+func TestDedupDeferTimeout(t *testing.T) {
+	rst := make(chan []uint8, 10)
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	param.DedupCacheSize = 4096
+	param.DeferTimeout = 50
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		rst <- bytes
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+	e.RegisterHandler(0, 2, func(w ResponseWriter, req *Request) {
+		w.Defer()
+	})
+
+	var frame tFrame
+	frame.controlWord.code = gCodeCon
+	frame.controlWord.rid = 2
+	frame.controlWord.token = 5
+	frame.controlWord.payloadLen = 1
+	frame.payload = []uint8{1}
+	// 延迟应答超时后重传的请求收到缓存的复位连接帧
+	for i := 0; i < 2; i++ {
+		e.Receive(0, 1, 0x1, gFrameToBytes(&frame))
+		select {
+		case bytes := <-rst:
+			if bytes[0]>>5 != gCodeRst || bytes[4] != SystemErrorTxTimeout|0x80 {
+				t.Fatal("wrong rst frame", bytes)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("rst frame not sent", i)
+		}
+	}
+}
+
+func TestRttEstimate(t *testing.T) {
+	a, b := testNewEndpointPair()
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, SystemOK
+	})
+	if _, ok := a.RttEstimate(1, 0x2); ok {
+		t.Fatal("rtt should not exist before call")
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := a.Call(0, 1, 0x2, 1, 3000, []uint8{1}); err != SystemOK {
+			t.Fatal("call failed", err)
+		}
+	}
+	info, ok := a.RttEstimate(1, 0x2)
+	if ok == false || info.Samples != 5 || info.Rto < 10*time.Millisecond {
+		t.Fatal("wrong rtt estimate", info)
+	}
+
+	param := a.getParam()
+	param.IsAdaptiveRetry = true
+	a.load(&param)
+	for i := 0; i < 4; i++ {
+		interval := a.retryInterval(1, 0x2, i)
+		if interval < int64(info.Rto/time.Microsecond)<<uint(i) {
+			t.Fatal("wrong retry interval", i, interval)
+		}
+	}
+}
+
+func TestCallOption(t *testing.T) {
+	sendNum := 0
+	var mutex sync.Mutex
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		sendNum++
+		mutex.Unlock()
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	begin := time.Now()
+	_, err := e.CallContext(context.Background(), 0, 1, 0x1234, 1, []uint8{1}, WithRetries(3),
+		WithRetryInterval(20*time.Millisecond), WithPriority(1))
+	if err != SystemErrorRxTimeout || time.Since(begin) > time.Second {
+		t.Fatal("call should fail fast", err, time.Since(begin))
+	}
+	mutex.Lock()
+	if sendNum != 3 {
+		t.Fatal("wrong send num", sendNum)
+	}
+	sendNum = 0
+	mutex.Unlock()
+
+	_, err = e.CallContext(context.Background(), 0, 1, 0x1234, 1, []uint8{1}, WithNonConfirmable())
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err != SystemOK || sendNum != 1 {
+		t.Fatal("non confirmable call failed", err, sendNum)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	order := make(chan int, 10)
+	now := e.getTime()
+	timers := []*tTimer{
+		newTimer(0, func() { order <- 3 }),
+		newTimer(0, func() { order <- 2 }),
+		newTimer(1, func() { order <- 1 }),
+		newTimer(0, func() { order <- 0 }),
+	}
+	e.scheduler.schedule(timers[0], now+30000)
+	e.scheduler.schedule(timers[1], now+20000)
+	e.scheduler.schedule(timers[2], now+20000)
+	e.scheduler.schedule(timers[3], now+100000)
+	// 重新调度和取消
+	e.scheduler.schedule(timers[3], now+10000)
+	e.scheduler.cancel(timers[0])
+
+	for _, expect := range []int{0, 1, 2} {
+		select {
+		case v := <-order:
+			if v != expect {
+				t.Fatal("wrong timer order", v, expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timer not fired", expect)
+		}
+	}
+	select {
+	case v := <-order:
+		t.Fatal("canceled timer fired", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 截止时间为最大值的定时器不能使休眠时长溢出为负数
+	if d := schedulerWaitDuration(gTimeMax - now); d != time.Hour {
+		t.Fatal("wrong wait duration", d)
+	}
+
+	// 同一批到期的定时器按优先级执行
+	var s tScheduler
+	low := newTimer(0, nil)
+	high := newTimer(1, nil)
+	s.schedule(low, 10)
+	s.schedule(high, 20)
+	expired, _ := s.popExpired(30)
+	if len(expired) != 2 || expired[0] != high || expired[1] != low {
+		t.Fatal("expired timers should be ordered by priority")
+	}
+}
+
+func TestTokenAllocation(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var resps []*Resp
+	tokens := make(map[int]bool)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i <= gTokenMax; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1}, WithRetryInterval(time.Hour))
+			mutex.Lock()
+			resps = append(resps, resp)
+			tokens[resp.token] = true
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(tokens) != gTokenMax+1 || e.tokensInUse(1, 0x10) != gTokenMax+1 {
+		t.Fatal("token collision", len(tokens))
+	}
+
+	_, err := e.CallContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	if err != SystemErrorTokenExhausted {
+		t.Fatal("token should be exhausted", err)
+	}
+	resp := e.CallAsyncContext(ctx, 0, 1, 0x11, 1, []uint8{1}, WithRetryInterval(time.Hour))
+	if resp.token != 0 {
+		t.Fatal("token of other peer should be independent", resp.token)
+	}
+
+	cancel()
+	for _, resp := range resps {
+		<-resp.Done
+	}
+	<-resp.Done
+	if e.tokensInUse(1, 0x10) != 0 || e.tokensInUse(1, 0x11) != 0 {
+		t.Fatal("token not released", e.tokensInUse(1, 0x10))
+	}
+	e.tokens.mutex.Lock()
+	peerNum := len(e.tokens.items)
+	e.tokens.mutex.Unlock()
+	if peerNum != 0 {
+		t.Fatal("idle peer not deleted", peerNum)
+	}
+
+	// 删除的对端不会从头分配刚释放的token
+	var last int
+	for i := 0; i < 2; i++ {
+		resp = e.CallAsyncContext(context.Background(), 0, 2, 0x12, 1, []uint8{1}, WithRetries(1),
+			WithRetryInterval(time.Millisecond))
+		<-resp.Done
+		if i > 0 && resp.token == last {
+			t.Fatal("token should continue after peer deleted", resp.token)
+		}
+		last = resp.token
+	}
+}
+
+func TestInflightLimit(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.MaxInflightPerPeer = 1
+	param.InflightPolicy = InflightPolicyReject
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	_, err := e.CallContext(context.Background(), 0, 1, 0x10, 1, []uint8{1})
+	if err != SystemErrorNotEnoughMemory {
+		t.Fatal("call should be rejected", err)
+	}
+	other := e.CallAsyncContext(ctx, 0, 1, 0x11, 1, []uint8{1})
+	info := e.InflightState(1, 0x10)
+	if info.Total != 2 || info.Pipe != 2 || info.Peer != 1 || info.TotalQueued != 0 {
+		t.Fatal("wrong inflight state", info)
+	}
+	cancel()
+	<-first.Done
+	<-other.Done
+
+	// 排队
+	param.InflightPolicy = InflightPolicyQueue
+	e.load(&param)
+	ctx, cancel = context.WithCancel(context.Background())
+	first = e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	second := e.CallAsyncContext(context.Background(), 0, 1, 0x10, 1, []uint8{1}, WithRetries(1))
+	info = e.InflightState(1, 0x10)
+	if info.Peer != 1 || info.PeerQueued != 1 {
+		t.Fatal("call should be queued", info)
+	}
+	cancel()
+	<-first.Done
+	resp := <-second.Done
+	if resp.Error != SystemErrorRxTimeout {
+		t.Fatal("queued call should be sent after slot released", resp.Error)
+	}
+	info = e.InflightState(1, 0x10)
+	if info.Total != 0 || info.TotalQueued != 0 {
+		t.Fatal("slot not released", info)
+	}
+
+	// 阻塞
+	param.InflightPolicy = InflightPolicyBlock
+	e.load(&param)
+	ctx, cancel = context.WithCancel(context.Background())
+	first = e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), time.Second)
+	defer timeoutCancel()
+	second = e.CallAsyncContext(timeoutCtx, 0, 1, 0x10, 1, []uint8{1})
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("call should block until slot released")
+	}
+	if e.InflightState(1, 0x10).Peer != 1 {
+		t.Fatal("blocked call should be sent")
+	}
+	<-first.Done
+}
+
+func TestInflightPeerQueues(t *testing.T) {
+	var mutex sync.Mutex
+	var order []uint8
+	isSent := make(map[uint8]bool)
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.MaxInflight = 1
+	param.InflightPolicy = InflightPolicyQueue
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// 只记录每个调用的首次发送
+		payload := bytes[len(bytes)-1]
+		if isSent[payload] == false {
+			isSent[payload] = true
+			order = append(order, payload)
+		}
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	var resps []*Resp
+	for i, ia := range []uint64{0x11, 0x11, 0x11, 0x12} {
+		resps = append(resps, e.CallAsyncContext(context.Background(), 0, 1, ia, 1, []uint8{uint8(i + 2)},
+			WithRetries(1), WithRetryInterval(time.Millisecond)))
+	}
+	info := e.InflightState(1, 0x11)
+	if info.Total != 1 || info.TotalQueued != 4 || info.PipeQueued != 4 || info.PeerQueued != 3 {
+		t.Fatal("wrong inflight state", info)
+	}
+
+	cancel()
+	<-first.Done
+	for _, resp := range resps {
+		<-resp.Done
+	}
+	// 不同对端轮流分配名额,同一对端按排队顺序
+	mutex.Lock()
+	defer mutex.Unlock()
+	if bytes.Equal(order, []uint8{1, 2, 5, 3, 4}) == false {
+		t.Fatal("wrong send order", order)
+	}
+	info = e.InflightState(1, 0x11)
+	if info.Total != 0 || info.TotalQueued != 0 || info.PipeQueued != 0 {
+		t.Fatal("slot not released", info)
+	}
+}
+
+func TestOutboundQueue(t *testing.T) {
+	var mutex sync.Mutex
+	isAllow := false
+	var sent [][]uint8
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.OutboundQueueSize = 2
+	param.IsAllowSend = func(pipe uint64) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return isAllow
+	}
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, bytes)
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	for i := 1; i <= 3; i++ {
+		_, err := e.CallContext(context.Background(), 0, 1, 0x10, 1, []uint8{uint8(i)}, WithNonConfirmable())
+		if err != SystemOK {
+			t.Fatal("non call failed", err)
+		}
+	}
+	if e.outboundQueueLen(1) != 2 || len(sent) != 0 {
+		t.Fatal("frames should be queued", e.outboundQueueLen(1), len(sent))
+	}
+
+	mutex.Lock()
+	isAllow = true
+	mutex.Unlock()
+	e.NotifyPipeReady(1)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sent) != 2 || sent[0][len(sent[0])-1] != 2 || sent[1][len(sent[1])-1] != 3 {
+		t.Fatal("queued frames not flushed in order", sent)
+	}
+	if e.outboundQueueLen(1) != 0 {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestOutboundQueueRetry(t *testing.T) {
+	var mutex sync.Mutex
+	isAllow := false
+	var sent [][]uint8
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.OutboundQueueSize = 2
+	param.IsAllowSend = func(pipe uint64) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return isAllow
+	}
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, bytes)
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	_, err := e.CallContext(context.Background(), 0, 1, 0x10, 1, []uint8{1}, WithNonConfirmable())
+	if err != SystemOK {
+		t.Fatal("non call failed", err)
+	}
+	// CON请求的重传不能挤出队列中的NON帧
+	_, err = e.CallContext(context.Background(), 0, 1, 0x10, 1, []uint8{2}, WithRetries(5),
+		WithRetryInterval(time.Millisecond))
+	if err != SystemErrorRxTimeout {
+		t.Fatal("con call should time out", err)
+	}
+	if e.outboundQueueLen(1) != 2 {
+		t.Fatal("retry should not be queued again", e.outboundQueueLen(1))
+	}
+
+	// 已结束的请求不再发送
+	mutex.Lock()
+	isAllow = true
+	mutex.Unlock()
+	e.NotifyPipeReady(1)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sent) != 1 || sent[0][len(sent[0])-1] != 1 {
+		t.Fatal("only non frame should be sent", sent)
+	}
+}
+
+func TestCallPriority(t *testing.T) {
+	var mutex sync.Mutex
+	isAllow := true
+	var order []uint8
+	isSent := make(map[uint8]bool)
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.MaxInflightPerPeer = 1
+	param.InflightPolicy = InflightPolicyQueue
+	param.OutboundQueueSize = 10
+	param.IsAllowSend = func(pipe uint64) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return isAllow
+	}
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// 只记录每个调用的首次发送
+		payload := bytes[len(bytes)-1]
+		if isSent[payload] == false {
+			isSent[payload] = true
+			order = append(order, payload)
+		}
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	// 高优先级的调用越过排队的低优先级调用先占用名额
+	ctx, cancel := context.WithCancel(context.Background())
+	first := e.CallAsyncContext(ctx, 0, 1, 0x10, 1, []uint8{1})
+	var resps []*Resp
+	for i, priority := range []int{0, 0, 1} {
+		resps = append(resps, e.CallAsyncContext(context.Background(), 0, 1, 0x10, 1, []uint8{uint8(i + 2)},
+			WithRetries(1), WithRetryInterval(time.Millisecond), WithPriority(priority)))
+	}
+	cancel()
+	<-first.Done
+	for _, resp := range resps {
+		<-resp.Done
+	}
+
+	// 发送队列中高优先级的帧先发送
+	mutex.Lock()
+	isAllow = false
+	mutex.Unlock()
+	for i, priority := range []int{0, 0, 1} {
+		_, err := e.CallContext(context.Background(), 0, 1, 0x11, 1, []uint8{uint8(i + 5)}, WithNonConfirmable(),
+			WithPriority(priority))
+		if err != SystemOK {
+			t.Fatal("non call failed", err)
+		}
+	}
+	mutex.Lock()
+	isAllow = true
+	mutex.Unlock()
+	e.NotifyPipeReady(1)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if bytes.Equal(order, []uint8{1, 4, 2, 3, 7, 5, 6}) == false {
+		t.Fatal("wrong send order", order)
+	}
+}
+
+func TestBlockWindow(t *testing.T) {
+	var mutex sync.Mutex
+	var offsets []int
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		offsets = append(offsets, gByetsToBlockFrame(bytes).blockHeader.offset)
+	}
+	e := NewEndpoint(&param)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// 不等待应答
+	defer e.Close(ctx)
+	e.SetBlockWindow(1, 4)
+
+	// 每帧载荷249字节
+	resp := e.CallAsync(0, 1, 0x10, 1, 3000, make([]uint8, 2000))
+	back := func(offset int) []int {
+		mutex.Lock()
+		offsets = nil
+		mutex.Unlock()
+		var frame tFrame
+		frame.controlWord.code = gCodeBack
+		frame.controlWord.token = resp.token
+		frame.controlWord.rid = 1
+		frame.controlWord.payloadLen = 2
+		frame.payload = []uint8{uint8(offset >> 8), uint8(offset)}
+		e.Receive(0, 1, 0x10, gFrameToBytes(&frame))
+		mutex.Lock()
+		defer mutex.Unlock()
+		return offsets
+	}
+	check := func(got []int, expect ...int) {
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Fatal("wrong offsets", got, expect)
+		}
+	}
+
+	// 收到首帧确认后填满窗口
+	check(back(249), 249, 498, 747, 996)
+	// 窗口滑动一帧
+	check(back(498), 1245)
+	// 重复确认回退重发
+	check(back(498), 498, 747, 996, 1245)
+	// 过期确认忽略
+	check(back(249))
+	check(back(1743), 1743, 1992)
+	check(back(2000))
+	if e.blockTxItems.len() != 0 {
+		t.Fatal("block tx should end")
+	}
+}
+
+func TestBlockSack(t *testing.T) {
+	var mutex sync.Mutex
+	var offsets []int
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		offsets = append(offsets, gByetsToBlockFrame(bytes).blockHeader.offset)
+	}
+	e := NewEndpoint(&param)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	defer e.Close(ctx)
+	e.SetBlockWindow(1, 4)
+
+	resp := e.CallAsync(0, 1, 0x10, 1, 3000, make([]uint8, 2000))
+	back := func(offset int, ranges ...tSackRange) []int {
+		mutex.Lock()
+		offsets = nil
+		mutex.Unlock()
+		var frame tFrame
+		frame.controlWord.code = gCodeBack
+		frame.controlWord.token = resp.token
+		frame.controlWord.rid = 1
+		frame.payload = gBackToBytes(offset, ranges, false)
+		frame.controlWord.payloadLen = len(frame.payload)
+		e.Receive(0, 1, 0x10, gFrameToBytes(&frame))
+		mutex.Lock()
+		defer mutex.Unlock()
+		return offsets
+	}
+	check := func(got []int, expect ...int) {
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Fatal("wrong offsets", got, expect)
+		}
+	}
+
+	check(back(249), 249, 498, 747, 996)
+	// 249丢失.重发缺失的帧,对端缓存的帧不占用窗口
+	check(back(249, tSackRange{498, 996}), 249, 1245, 1494)
+	// 没有新信息的重复确认再次重发缺失的帧
+	check(back(249, tSackRange{498, 996}), 249)
+	check(back(1245), 1743, 1992)
+	check(back(2000))
+}
+
+func TestBlockReassembly(t *testing.T) {
+	var mutex sync.Mutex
+	var backs [][]uint8
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		frame := gBytesToFrame(bytes)
+		if frame.controlWord.code != gCodeBack {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		backs = append(backs, frame.payload)
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+	req := make([]uint8, 1000)
+	for i := range req {
+		req[i] = uint8(i)
+	}
+	done := make(chan []uint8, 1)
+	e.Register(0, 1, func(pipe uint64, srcIA uint64, bytes []uint8) ([]uint8, int) {
+		done <- bytes
+		return nil, SystemOK
+	})
+
+	receive := func(offset int) []uint8 {
+		mutex.Lock()
+		backs = nil
+		mutex.Unlock()
+		var frame tBlockFrame
+		frame.controlWord.code = gCodeCon
+		frame.controlWord.blockFlag = 1
+		frame.controlWord.rid = 1
+		frame.controlWord.token = 1
+		frame.blockHeader.crc16 = crc16.Checksum(req)
+		frame.blockHeader.total = len(req)
+		frame.blockHeader.offset = offset
+		end := offset + 249
+		if end > len(req) {
+			end = len(req)
+		}
+		frame.payload = req[offset:end]
+		frame.controlWord.payloadLen = gBlockHeaderLen + len(frame.payload)
+		e.Receive(0, 1, 0x10, gBlockFrameToBytes(&frame))
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(backs) > 1 {
+			t.Fatal("wrong back num", len(backs))
+		}
+		if len(backs) == 0 {
+			return nil
+		}
+		return backs[0]
+	}
+	check := func(got []uint8, offset int, ranges ...tSackRange) {
+		expect := gBackToBytes(offset, ranges, false)
+		if bytes.Equal(got, expect) == false {
+			t.Fatal("wrong back", got, expect)
+		}
+	}
+
+	check(receive(0), 249)
+	check(receive(747), 249, tSackRange{747, 996})
+	check(receive(498), 249, tSackRange{498, 996})
+	// 重复的乱序帧不回复
+	if receive(498) != nil {
+		t.Fatal("duplicate frame should be ignored")
+	}
+	check(receive(249), 996)
+	check(receive(996), 1000)
+	if bytes.Equal(<-done, req) == false {
+		t.Fatal("wrong reassembled data")
+	}
+}
+
+func TestBlockExt(t *testing.T) {
+	header := tBlocHeader{crc16: 0x1234, total: 0x12345, offset: 0x10000, isExt: true}
+	data := gBlockHeaderToBytes(&header)
+	if len(data) != gBlockHeaderExtLen || *gBytesToBlockHeader(data) != header {
+		t.Fatal("ext header convert failed", data)
+	}
+
+	a, b := testNewEndpointPair()
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+	a.SetBlockWindow(1, 8)
+	b.SetBlockWindow(1, 8)
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req[:70000], SystemOK
+	})
+
+	req := make([]uint8, 100000)
+	for i := range req {
+		req[i] = uint8(i * 7)
+	}
+	resp, err := a.Call(0, 1, 0x2, 1, 10000, req)
+	if err != SystemOK || bytes.Equal(resp, req[:70000]) == false {
+		t.Fatal("ext block call failed", err, len(resp))
+	}
+}
+
+func TestBlockExtNotSupported(t *testing.T) {
+	var e *Endpoint
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	// 模拟不支持扩展的对端.16位偏移地址非0且没有接收任务时回复偏移地址错误
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		word := gBytesToControlWord(bytes)
+		if word.blockFlag == 0 || (int(bytes[8])<<8)+int(bytes[9]) == 0 {
+			return
+		}
+		var frame tFrame
+		frame.controlWord.code = gCodeRst
+		frame.controlWord.rid = word.rid
+		frame.controlWord.token = word.token
+		frame.controlWord.payloadLen = 1
+		frame.payload = []uint8{SystemErrorWrongBlockOffset | 0x80}
+		go e.Receive(protocol, pipe, dstIA, gFrameToBytes(&frame))
+	}
+	e = NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	resp := e.CallAsync(0, 1, 0x10, 1, 3000, make([]uint8, 70000))
+	<-resp.Done
+	if resp.Error != SystemErrorParamInvalid || errors.Is(resp.Err, errBlockExtNotSupported) == false {
+		t.Fatal("wrong error", resp.Error, resp.Err)
+	}
+	if e.blockTxItems.len() != 0 {
+		t.Fatal("block tx should be removed")
+	}
+
+	// 管道单帧放不下扩展头部
+	pipe := &testPipe{id: 2, mtu: gControlWordLen + gBlockHeaderExtLen}
+	if _, err := e.AddPipe(pipe); err != nil {
+		t.Fatal(err)
+	}
+	_, code := e.Call(0, 2, 0x10, 1, 3000, make([]uint8, 70000))
+	if code != SystemErrorParamInvalid {
+		t.Fatal("wrong error", code)
+	}
+}
+
+// testPipe 测试管道.发送的数据直接交给对端的接收函数
+type testPipe struct {
+	id       uint64
+	mtu      int
+	srcIA    uint64
+	receive  ReceiveFunc
+	mutex    sync.Mutex
+	frameMax int
+	isClosed bool
+	// 忙时不允许发送
+	isBusy bool
+}
+
+func (p *testPipe) ID() uint64 {
+	return p.id
+}
+
+func (p *testPipe) MTU() int {
+	return p.mtu
+}
+
+func (p *testPipe) Send(protocol int, dstIA uint64, bytes []uint8) error {
+	p.mutex.Lock()
+	if len(bytes) > p.frameMax {
+		p.frameMax = len(bytes)
+	}
+	receive := p.receive
+	p.mutex.Unlock()
+	go receive(protocol, p.srcIA, bytes)
+	return nil
+}
+
+func (p *testPipe) AllowSend() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.isBusy == false
+}
+
+func (p *testPipe) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.isClosed = true
+	return nil
+}
+
+func TestPipe(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := NewEndpoint(&param)
+	b := NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	pipeA := &testPipe{id: 5, mtu: 64, srcIA: 0x1}
+	pipeB := &testPipe{id: 5, mtu: 64, srcIA: 0x2}
+	receiveA, err := a.AddPipe(pipeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveB, err := b.AddPipe(pipeB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeA.receive = receiveB
+	pipeB.receive = receiveA
+	if _, err := a.AddPipe(&testPipe{id: 5}); errors.Is(err, ErrParamInvalid) == false {
+		t.Fatal("duplicate pipe should fail", err)
+	}
+	if _, err := a.AddPipe(&testPipe{id: 6, mtu: 8}); errors.Is(err, ErrParamInvalid) == false {
+		t.Fatal("small mtu should fail", err)
+	}
+
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, SystemOK
+	})
+	req := make([]uint8, 200)
+	for i := range req {
+		req[i] = uint8(i)
+	}
+	resp, code := a.Call(0, 5, 0x2, 1, 3000, req)
+	if code != SystemOK || len(resp) != 200 || resp[199] != 199 {
+		t.Fatal("call through pipe failed", code, len(resp))
+	}
+	if pipeA.frameMax > 64 || pipeB.frameMax > 64 {
+		t.Fatal("frame exceeds mtu", pipeA.frameMax, pipeB.frameMax)
+	}
+
+	if a.RemovePipe(5) != nil || pipeA.isClosed == false {
+		t.Fatal("remove pipe failed")
+	}
+	_, code = a.Call(0, 5, 0x2, 1, 300, []uint8{1})
+	if code != SystemErrorSendFailed {
+		t.Fatal("call on removed pipe should fail", code)
+	}
+}
+
+func TestPipeTeardown(t *testing.T) {
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	param.OutboundQueueSize = 4
+	a := NewEndpoint(&param)
+	b := NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	pipeA := &testPipe{id: 5, mtu: 64, srcIA: 0x1}
+	pipeB := &testPipe{id: 5, mtu: 64, srcIA: 0x2}
+	receiveA, _ := a.AddPipe(pipeA)
+	receiveB, _ := b.AddPipe(pipeB)
+	pipeA.receive = receiveB
+	pipeB.receive = receiveA
+
+	responders := make(chan *Responder, 1)
+	a.RegisterHandler(0, 2, func(w ResponseWriter, req *Request) {
+		responders <- w.Defer()
+	})
+	b.CallAsync(0, 5, 0x1, 2, 3000, []uint8{1})
+	r := <-responders
+
+	pipeA.mutex.Lock()
+	pipeA.isBusy = true
+	pipeA.mutex.Unlock()
+	a.CallAsync(0, 5, 0x2, 1, 0, []uint8{1})
+	if a.outboundQueueLen(5) != 1 {
+		t.Fatal("frame should be queued")
+	}
+
+	// 移除管道时清空发送队列并结束延迟应答
+	a.RemovePipe(5)
+	if a.outboundQueueLen(5) != 0 || a.deferItemsNum() != 0 {
+		t.Fatal("pipe state not cleared", a.outboundQueueLen(5), a.deferItemsNum())
+	}
+	var dcomErr *Error
+	if err := r.Ack([]uint8{1}); errors.As(err, &dcomErr) == false || dcomErr.Code != SystemErrorPipeClosed {
+		t.Fatal("ack after pipe removed should fail", err)
+	}
+}
+
+// testTemporaryError 测试用临时错误
+type testTemporaryError struct{}
+
+func (testTemporaryError) Error() string {
+	return "busy"
+}
+
+func (testTemporaryError) Temporary() bool {
+	return true
+}
+
+func TestSendError(t *testing.T) {
+	errUnplugged := errors.New("adapter unplugged")
+	var mutex sync.Mutex
+	var sendErr error
+	sendNum := 0
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 3
+	param.BlockRetryInterval = 50
+	param.IsAllowSend = testIsAllowSend
+	param.SendWithError = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sendNum++
+		return sendErr
+	}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	// 永久错误立即失败
+	sendErr = errUnplugged
+	start := time.Now()
+	_, err := e.Invoke(0, 1, 0x10, 1, 3000, []uint8{1})
+	if errors.Is(err, ErrSendFailed) == false || errors.Is(err, errUnplugged) == false {
+		t.Fatal("call should fail with send error", err)
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Fatal("call should fail immediately")
+	}
+	_, err = e.Invoke(0, 1, 0x10, 1, 3000, make([]uint8, 1000))
+	if errors.Is(err, ErrSendFailed) == false || e.blockTxItems.len() != 0 {
+		t.Fatal("block call should fail with send error", err)
+	}
+	fmt.Println(err)
+
+	// 临时错误计为重传
+	mutex.Lock()
+	sendErr = testTemporaryError{}
+	sendNum = 0
+	mutex.Unlock()
+	_, code := e.Call(0, 1, 0x10, 1, 3000, []uint8{1})
+	mutex.Lock()
+	defer mutex.Unlock()
+	if code != SystemErrorRxTimeout || sendNum != param.BlockRetryMaxNum {
+		t.Fatal("temporary error should be retried", code, sendNum)
+	}
+}
+
+func TestIsFrame(t *testing.T) {
+	if IsFrame([]uint8{0x20, 0x04, 0x00, 0x01, 0x01}) == false {
+		t.Fatal("valid frame")
+	}
+	if IsFrame([]uint8{0x20, 0x04, 0x00, 0x02, 0x01}) || IsFrame([]uint8{0xe0, 0x04, 0x00, 0x00}) {
+		t.Fatal("invalid frame")
+	}
+	if IsFrame([]uint8{0x30, 0x04, 0x00, 0x02, 0x01, 0x02}) {
+		t.Fatal("block frame without header")
+	}
+}
+
+// TestBuild32 检查32位平台能编译.常量和长度比较不能超出32位int的范围
+func TestBuild32(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip cross build in short mode")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command is not available")
+	}
+	for _, arch := range []string{"386", "arm"} {
+		cmd := exec.Command("go", "build", "./...")
+		cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal("build failed", arch, err, string(out))
+		}
+	}
+}
+
+func TestPipeTable(t *testing.T) {
+	if _, ok := UDPAddrToPipe(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 80}); ok {
+		t.Fatal("ipv6 address should not be encoded")
+	}
+
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {}
+	e := NewEndpoint(&param)
+	defer e.Close(context.Background())
+
+	table := e.NewPipeTable(true)
+	v4 := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 12025}
+	if table.Pipe(v4) != AddrToPipe(v4) {
+		t.Fatal("ipv4 should be compatible")
+	}
+	addr, ok := table.Addr(AddrToPipe(v4))
+	if ok == false || addr.String() != v4.String() {
+		t.Fatal("resolve ipv4 failed", addr)
+	}
+
+	addrs := []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 12025, Zone: "eth0"},
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 12025, Zone: "eth1"},
+		&net.UnixAddr{Name: "/tmp/dcom.sock", Net: "unixgram"},
+	}
+	pipes := make(map[uint64]bool)
+	for _, addr := range addrs {
+		pipe := table.Pipe(addr)
+		if table.Pipe(addr) != pipe {
+			t.Fatal("pipe is not stable", addr)
+		}
+		resolved, ok := table.Addr(pipe)
+		if ok == false || resolved.String() != addr.String() {
+			t.Fatal("resolve failed", addr, resolved)
+		}
+		pipes[pipe] = true
+	}
+	if len(pipes) != len(addrs) {
+		t.Fatal("pipe collision")
+	}
+
+	pipe := table.Pipe(addrs[2])
+	table.Remove(pipe)
+	if _, ok := table.Addr(pipe); ok {
+		t.Fatal("removed pipe should not resolve")
+	}
+
+	// 同一端点的多个地址表共用管道号分配
+	other := e.NewPipeTable(true)
+	pipe = other.Pipe(addrs[0])
+	if pipes[pipe] {
+		t.Fatal("pipe collision between tables", pipe)
+	}
+	if e.AllocPipeID() == pipe {
+		t.Fatal("alloc pipe id collision")
+	}
+}
+
+// benchmarkInflight 在10k个进行中的调用背景下测试调用吞吐量
+func benchmarkInflight(b *testing.B, inflightNum int) {
+	var x, y *Endpoint
+	var param LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 1000
+	param.IsAllowSend = testIsAllowSend
+	param.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		// 只有发往y的帧能送达,其他调用一直处于等待状态
+		if dstIA == 0x2 {
+			y.Receive(protocol, pipe, 0x1, bytes)
+		}
+	}
+	paramY := param
+	paramY.Send = func(protocol int, pipe uint64, dstIA uint64, bytes []uint8) {
+		x.Receive(protocol, pipe, 0x2, bytes)
+	}
+	x = NewEndpoint(&param)
+	y = NewEndpoint(&paramY)
+	y.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, SystemOK
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < inflightNum; i++ {
+		x.CallAsyncContext(ctx, 0, 1, uint64(0x100+i%64), i/64, []uint8{1}, WithRetries(1000),
+			WithRetryInterval(time.Hour))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := x.CallContext(context.Background(), 0, 1, 0x2, 1, []uint8{1, 2, 3})
+			if err != SystemOK {
+				b.Fatal("call failed", err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	cancel()
+	x.Close(context.Background())
+	y.Close(context.Background())
+}
+
+func BenchmarkCall(b *testing.B) {
+	benchmarkInflight(b, 0)
+}
+
+func BenchmarkCallInflight10k(b *testing.B) {
+	benchmarkInflight(b, 10000)
+}
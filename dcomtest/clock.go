@@ -0,0 +1,107 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 手动时钟模块.时间只在调用Advance时前进,用于确定性地测试重传和超时
+// Authors: jdh99 <jdh821@163.com>
+
+package dcomtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+// Clock 手动时钟.实现dcom.Clock
+type Clock struct {
+	now    time.Time
+	timers map[*tClockTimer]bool
+	mutex  sync.Mutex
+}
+
+// tClockTimer 手动时钟的定时器
+type tClockTimer struct {
+	c  *Clock
+	at time.Time
+	ch chan time.Time
+}
+
+// NewClock 创建手动时钟.start是初始时间
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.timers = make(map[*tClockTimer]bool)
+	return c
+}
+
+// Now 当前时间
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// NewTimer 创建定时器
+func (c *Clock) NewTimer(d time.Duration) dcom.ClockTimer {
+	t := &tClockTimer{c: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance 时间前进d.到期的定时器按截止时间顺序触发
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	for {
+		var first *tClockTimer
+		for t := range c.timers {
+			if t.at.After(c.now) == false && (first == nil || t.at.Before(first.at)) {
+				first = t
+			}
+		}
+		if first == nil {
+			return
+		}
+		delete(c.timers, first)
+		select {
+		case first.ch <- c.now:
+		default:
+		}
+	}
+}
+
+// Timers 运行中的定时器数
+func (c *Clock) Timers() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+func (t *tClockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *tClockTimer) Stop() bool {
+	t.c.mutex.Lock()
+	defer t.c.mutex.Unlock()
+	isActive := t.c.timers[t]
+	delete(t.c.timers, t)
+	return isActive
+}
+
+func (t *tClockTimer) Reset(d time.Duration) bool {
+	t.c.mutex.Lock()
+	defer t.c.mutex.Unlock()
+	isActive := t.c.timers[t]
+	t.at = t.c.now.Add(d)
+	if d <= 0 {
+		delete(t.c.timers, t)
+		select {
+		case t.ch <- t.c.now:
+		default:
+		}
+		return isActive
+	}
+	t.c.timers[t] = true
+	return isActive
+}
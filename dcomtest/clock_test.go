@@ -0,0 +1,214 @@
+package dcomtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+func newClockPair(t *testing.T, n *Network, clock *Clock) (*dcom.Endpoint, *dcom.Endpoint) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 3
+	param.BlockRetryInterval = 100
+	param.Clock = clock
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	if err := n.Join(a, 0x1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Join(b, 0x2, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return nil, dcom.SystemOK
+	})
+	return a, b
+}
+
+// closeNow 立即关闭端点.手动时钟不前进时进行中的调用不会结束
+func closeNow(e *dcom.Endpoint) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	e.Close(ctx)
+}
+
+// waitSent 等待链路发送帧数达到num
+func waitSent(t *testing.T, n *Network, srcIA uint64, dstIA uint64, num int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for n.Stats(srcIA, dstIA).Sent != num {
+		if time.Now().After(deadline) {
+			t.Fatal("wait sent timeout", srcIA, dstIA, n.Stats(srcIA, dstIA), num)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func waitResp(t *testing.T, resp *dcom.Resp, code int) {
+	select {
+	case <-resp.Done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait resp timeout")
+	}
+	if resp.Error != code {
+		t.Fatal("wrong code", resp.Error, code)
+	}
+}
+
+func TestClockRetry(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	n := NewNetwork(4)
+	defer n.Close()
+	a, b := newClockPair(t, n, clock)
+	defer closeNow(a)
+	defer closeNow(b)
+	n.SetLink(0x1, 0x2, LinkParam{Loss: 1})
+
+	// 每100ms重传一次,第3次到期时重传次数用尽
+	resp := a.CallAsync(0, 1, 0x2, 1, 10000, []uint8{1})
+	for i := 1; i <= 3; i++ {
+		waitSent(t, n, 0x1, 0x2, i)
+		clock.Advance(99 * time.Millisecond)
+		if n.Stats(0x1, 0x2).Sent != i {
+			t.Fatal("retry too early", i)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	waitResp(t, resp, dcom.SystemErrorRxTimeout)
+	if n.Stats(0x1, 0x2).Sent != 3 {
+		t.Fatal("wrong sent num", n.Stats(0x1, 0x2))
+	}
+}
+
+func TestClockRxTimeout(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	n := NewNetwork(5)
+	defer n.Close()
+	a, b := newClockPair(t, n, clock)
+	defer closeNow(a)
+	defer closeNow(b)
+	n.SetLink(0x1, 0x2, LinkParam{Loss: 1})
+
+	resp := a.CallAsync(0, 1, 0x2, 1, 150, []uint8{1})
+	waitSent(t, n, 0x1, 0x2, 1)
+	clock.Advance(100 * time.Millisecond)
+	waitSent(t, n, 0x1, 0x2, 2)
+	clock.Advance(49 * time.Millisecond)
+	select {
+	case <-resp.Done:
+		t.Fatal("timeout too early")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	waitResp(t, resp, dcom.SystemErrorRxTimeout)
+}
+
+func TestClockBlockRemove(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	n := NewNetwork(6)
+	defer n.Close()
+	a, b := newClockPair(t, n, clock)
+	defer closeNow(a)
+	defer closeNow(b)
+	// BACK帧全部丢失.发送方重发首帧,接收方重发BACK,重试次数用尽后都删除块传输
+	n.SetLink(0x2, 0x1, LinkParam{Loss: 1})
+
+	resp := a.CallAsync(0, 1, 0x2, 1, 1000, make([]uint8, 1000))
+	// 首帧在0,100,200ms发送,300ms删除.BACK在0,100,200,300ms发送,400ms删除
+	for i := 1; i <= 4; i++ {
+		if i <= 3 {
+			waitSent(t, n, 0x1, 0x2, i)
+		}
+		waitSent(t, n, 0x2, 0x1, i)
+		clock.Advance(100 * time.Millisecond)
+	}
+	clock.Advance(600 * time.Millisecond)
+	waitResp(t, resp, dcom.SystemErrorRxTimeout)
+	if n.Stats(0x1, 0x2).Sent != 3 || n.Stats(0x2, 0x1).Sent != 4 {
+		t.Fatal("block transfer not removed", n.Stats(0x1, 0x2), n.Stats(0x2, 0x1))
+	}
+}
+
+func TestClockDeadline(t *testing.T) {
+	clock := NewClock(time.Now())
+	n := NewNetwork(9)
+	defer n.Close()
+	a, b := newClockPair(t, n, clock)
+	defer closeNow(a)
+	defer closeNow(b)
+	n.SetLink(0x1, 0x2, LinkParam{Loss: 1})
+
+	// ctx的截止时间按端点时钟计算,端点时钟已前进30min
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Hour))
+	defer cancel()
+	clock.Advance(30 * time.Minute)
+	resp := a.CallAsyncContext(ctx, 0, 1, 0x2, 1, []uint8{1}, dcom.WithRetries(100),
+		dcom.WithRetryInterval(time.Hour))
+	waitSent(t, n, 0x1, 0x2, 1)
+	clock.Advance(30*time.Minute - time.Millisecond)
+	select {
+	case <-resp.Done:
+		t.Fatal("timeout too early")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	waitResp(t, resp, dcom.SystemErrorRxTimeout)
+}
+
+func TestClockHandlerTimeout(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 3
+	param.BlockRetryInterval = 100
+	param.HandlerTimeout = 50
+	param.Clock = clock
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	defer closeNow(a)
+	defer closeNow(b)
+	n := NewNetwork(10)
+	defer n.Close()
+	n.Join(a, 0x1, 1, 0)
+	n.Join(b, 0x2, 1, 0)
+
+	deadlines := make(chan time.Time, 1)
+	errs := make(chan error, 1)
+	b.RegisterHandler(0, 1, func(w dcom.ResponseWriter, req *dcom.Request) {
+		deadline, _ := req.Context().Deadline()
+		deadlines <- deadline
+		<-req.Context().Done()
+		errs <- req.Context().Err()
+	})
+
+	// 处理函数的截止时间按端点时钟计算
+	a.CallAsync(0, 1, 0x2, 1, 3000, []uint8{1})
+	if deadline := <-deadlines; deadline.Equal(time.Unix(0, 0).Add(50*time.Millisecond)) == false {
+		t.Fatal("wrong handler deadline", deadline)
+	}
+	clock.Advance(49 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatal("handler timeout too early", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatal("wrong handler ctx err", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler ctx not done")
+	}
+
+	// NON调用按端点时钟结束
+	resp := a.CallAsync(0, 1, 0x2, 2, 0, []uint8{1})
+	select {
+	case <-resp.Done:
+		t.Fatal("non call should end by clock")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	waitResp(t, resp, dcom.SystemOK)
+}
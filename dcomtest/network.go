@@ -0,0 +1,329 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 测试辅助模块.内存虚拟网络按IA连接多个端点,每条链路可以设置丢包,重复,乱序,延迟和带宽
+// Authors: jdh99 <jdh821@163.com>
+
+package dcomtest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+// ErrExist 地址已加入网络
+var ErrExist = errors.New("dcomtest: ia is exist")
+
+// LinkParam 链路参数
+type LinkParam struct {
+	// 丢包率.范围:0-1
+	Loss float64
+	// 重复率.范围:0-1
+	Duplicate float64
+	// 乱序率.范围:0-1.乱序的帧额外延迟一个Latency,没有延迟时额外延迟1ms
+	Reorder float64
+	// 延迟和随机抖动
+	Latency time.Duration
+	Jitter  time.Duration
+	// 带宽.单位:字节每秒.为0表示不限制
+	Bandwidth int
+}
+
+// LinkStats 链路统计
+type LinkStats struct {
+	// 发送帧数
+	Sent int
+	// 丢弃帧数
+	Dropped int
+	// 重复帧数
+	Duplicated int
+	// 送达帧数.包括重复的帧
+	Delivered int
+}
+
+// tLinkKey 链路关键字.链路是单向的
+type tLinkKey struct {
+	srcIA uint64
+	dstIA uint64
+}
+
+// tLink 链路
+type tLink struct {
+	param LinkParam
+	stats LinkStats
+	// 是否单独设置了参数
+	isCustom bool
+	// 带宽限制下链路空闲的时刻
+	busyUntil time.Time
+
+	// 待送达的帧.按送达时刻排序,由投递线程依次送达
+	packets   []*tPacket
+	isRunning bool
+	wake      chan struct{}
+}
+
+// tPacket 链路上待送达的帧
+type tPacket struct {
+	at       time.Time
+	dst      *tNode
+	protocol int
+	srcIA    uint64
+	bytes    []uint8
+}
+
+// tNode 网络中的端点
+type tNode struct {
+	n       *Network
+	ia      uint64
+	pipe    uint64
+	mtu     int
+	receive dcom.ReceiveFunc
+}
+
+// Network 内存虚拟网络
+type Network struct {
+	nodes       map[uint64]*tNode
+	links       map[tLinkKey]*tLink
+	defaultLink LinkParam
+	rand        *rand.Rand
+	isClosed    bool
+	mutex       sync.Mutex
+	wg          sync.WaitGroup
+
+	// 未送达完成的帧数.包括正在送达的帧
+	pending int
+	// pending减为0时通知Drain
+	drained *sync.Cond
+}
+
+// NewNetwork 创建网络.seed是随机数种子,相同种子的丢包等行为可以复现
+func NewNetwork(seed int64) *Network {
+	n := &Network{}
+	n.nodes = make(map[uint64]*tNode)
+	n.links = make(map[tLinkKey]*tLink)
+	n.rand = rand.New(rand.NewSource(seed))
+	n.drained = sync.NewCond(&n.mutex)
+	return n
+}
+
+// Join 端点以地址ia加入网络.网络作为管道pipe添加到端点,mtu为0时使用DCOM默认值
+func (n *Network) Join(e *dcom.Endpoint, ia uint64, pipe uint64, mtu int) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.nodes[ia]; ok {
+		return ErrExist
+	}
+	node := &tNode{n: n, ia: ia, pipe: pipe, mtu: mtu}
+	receive, err := e.AddPipe(node)
+	if err != nil {
+		return err
+	}
+	node.receive = receive
+	n.nodes[ia] = node
+	return nil
+}
+
+// SetDefaultLink 设置默认链路参数.没有单独设置的链路使用默认参数
+func (n *Network) SetDefaultLink(param LinkParam) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.defaultLink = param
+	for _, link := range n.links {
+		if link.isCustom == false {
+			link.param = param
+		}
+	}
+}
+
+// SetLink 设置从srcIA到dstIA的单向链路参数
+func (n *Network) SetLink(srcIA uint64, dstIA uint64, param LinkParam) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	link := n.getLink(srcIA, dstIA)
+	link.param = param
+	link.isCustom = true
+}
+
+// Stats 读取从srcIA到dstIA的链路统计
+func (n *Network) Stats(srcIA uint64, dstIA uint64) LinkStats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.getLink(srcIA, dstIA).stats
+}
+
+// getLink 读取链路.不存在时使用默认参数创建.调用者需持有锁
+func (n *Network) getLink(srcIA uint64, dstIA uint64) *tLink {
+	key := tLinkKey{srcIA: srcIA, dstIA: dstIA}
+	link, ok := n.links[key]
+	if ok == false {
+		link = &tLink{param: n.defaultLink, wake: make(chan struct{}, 1)}
+		n.links[key] = link
+	}
+	return link
+}
+
+// Drain 等待所有链路上的帧送达.端点收到帧后发送的帧也会等待
+// 端点仍在重传时可能一直等待,调用者需保证调用已经结束
+func (n *Network) Drain() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for n.pending > 0 && n.isClosed == false {
+		n.drained.Wait()
+	}
+}
+
+// Close 关闭网络.丢弃所有未送达的帧并等待送达线程退出
+func (n *Network) Close() {
+	n.mutex.Lock()
+	n.isClosed = true
+	n.drained.Broadcast()
+	n.mutex.Unlock()
+	n.wg.Wait()
+}
+
+// done 一个帧送达完成或者被丢弃.调用者需持有锁
+func (n *Network) done(num int) {
+	n.pending -= num
+	if n.pending == 0 {
+		n.drained.Broadcast()
+	}
+}
+
+// transfer 按链路参数投递帧
+func (n *Network) transfer(src *tNode, protocol int, dstIA uint64, bytes []uint8) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.isClosed {
+		return
+	}
+	link := n.getLink(src.ia, dstIA)
+	link.stats.Sent++
+	dst, ok := n.nodes[dstIA]
+	if ok == false || n.rand.Float64() < link.param.Loss {
+		link.stats.Dropped++
+		return
+	}
+
+	// 带宽限制下帧依次占用链路
+	now := time.Now()
+	if link.busyUntil.Before(now) {
+		link.busyUntil = now
+	}
+	if link.param.Bandwidth > 0 {
+		link.busyUntil = link.busyUntil.Add(time.Duration(len(bytes)) * time.Second /
+			time.Duration(link.param.Bandwidth))
+	}
+
+	num := 1
+	if n.rand.Float64() < link.param.Duplicate {
+		link.stats.Duplicated++
+		num++
+	}
+	for i := 0; i < num; i++ {
+		delay := link.busyUntil.Sub(now) + link.param.Latency
+		if link.param.Jitter > 0 {
+			delay += time.Duration(n.rand.Int63n(int64(link.param.Jitter)))
+		}
+		if n.rand.Float64() < link.param.Reorder {
+			extra := link.param.Latency
+			if extra == 0 {
+				extra = time.Millisecond
+			}
+			delay += extra
+		}
+		n.deliver(link, dst, protocol, src.ia, bytes, delay)
+	}
+}
+
+// deliver 延迟delay后送达.调用者需持有锁
+// 同一链路的帧按送达时刻依次送达,送达时刻相同时按发送顺序
+func (n *Network) deliver(link *tLink, dst *tNode, protocol int, srcIA uint64, bytes []uint8, delay time.Duration) {
+	packet := &tPacket{at: time.Now().Add(delay), dst: dst, protocol: protocol, srcIA: srcIA}
+	packet.bytes = make([]uint8, len(bytes))
+	copy(packet.bytes, bytes)
+
+	i := len(link.packets)
+	for i > 0 && link.packets[i-1].at.After(packet.at) {
+		i--
+	}
+	link.packets = append(link.packets, nil)
+	copy(link.packets[i+1:], link.packets[i:])
+	link.packets[i] = packet
+	n.pending++
+
+	if link.isRunning == false {
+		link.isRunning = true
+		n.wg.Add(1)
+		go n.threadDeliver(link)
+	} else if i == 0 {
+		select {
+		case link.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// threadDeliver 链路投递线程.没有待送达的帧时退出
+func (n *Network) threadDeliver(link *tLink) {
+	defer n.wg.Done()
+	for {
+		n.mutex.Lock()
+		if n.isClosed || len(link.packets) == 0 {
+			n.done(len(link.packets))
+			link.packets = nil
+			link.isRunning = false
+			n.mutex.Unlock()
+			return
+		}
+		packet := link.packets[0]
+		delay := time.Until(packet.at)
+		if delay > 0 {
+			n.mutex.Unlock()
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-link.wake:
+				timer.Stop()
+			}
+			continue
+		}
+		link.packets = link.packets[1:]
+		link.stats.Delivered++
+		n.mutex.Unlock()
+		packet.dst.receive(packet.protocol, packet.srcIA, packet.bytes)
+
+		n.mutex.Lock()
+		n.done(1)
+		n.mutex.Unlock()
+	}
+}
+
+func (node *tNode) ID() uint64 {
+	return node.pipe
+}
+
+func (node *tNode) MTU() int {
+	return node.mtu
+}
+
+func (node *tNode) Send(protocol int, dstIA uint64, bytes []uint8) error {
+	node.n.transfer(node, protocol, dstIA, bytes)
+	return nil
+}
+
+func (node *tNode) AllowSend() bool {
+	return true
+}
+
+func (node *tNode) Close() error {
+	node.n.mutex.Lock()
+	defer node.n.mutex.Unlock()
+	if node.n.nodes[node.ia] == node {
+		delete(node.n.nodes, node.ia)
+	}
+	return nil
+}
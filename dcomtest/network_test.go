@@ -0,0 +1,130 @@
+package dcomtest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+func newPair(t *testing.T, n *Network, retryInterval int) (*dcom.Endpoint, *dcom.Endpoint) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 10
+	param.BlockRetryInterval = retryInterval
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	if err := n.Join(a, 0x1, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Join(b, 0x2, 1, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Join(b, 0x2, 1, 0); err != ErrExist {
+		t.Fatal("join twice should fail", err)
+	}
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, dcom.SystemOK
+	})
+	return a, b
+}
+
+func testCalls(t *testing.T, a *dcom.Endpoint, num int, sizeMax int) {
+	for i := 0; i < num; i++ {
+		req := make([]uint8, 1+i*97%sizeMax)
+		for j := range req {
+			req[j] = uint8(i + j)
+		}
+		resp, code := a.Call(0, 1, 0x2, 1, 5000, req)
+		if code != dcom.SystemOK || bytes.Equal(resp, req) == false {
+			t.Fatal("call failed", i, code, len(resp), len(req))
+		}
+	}
+}
+
+func TestLoss(t *testing.T) {
+	n := NewNetwork(1)
+	defer n.Close()
+	n.SetDefaultLink(LinkParam{Loss: 0.2})
+	a, b := newPair(t, n, 20)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	testCalls(t, a, 20, 1000)
+	if n.Stats(0x1, 0x2).Dropped == 0 || n.Stats(0x2, 0x1).Dropped == 0 {
+		t.Fatal("no frame dropped", n.Stats(0x1, 0x2), n.Stats(0x2, 0x1))
+	}
+}
+
+func TestDuplicateAndReorder(t *testing.T) {
+	n := NewNetwork(2)
+	defer n.Close()
+	n.SetDefaultLink(LinkParam{Duplicate: 0.3, Reorder: 0.3, Latency: time.Millisecond, Jitter: time.Millisecond})
+	a, b := newPair(t, n, 20)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	testCalls(t, a, 20, 1000)
+	// 等待延迟中的帧送达
+	n.Drain()
+	stats := n.Stats(0x1, 0x2)
+	if stats.Duplicated == 0 || stats.Delivered != stats.Sent+stats.Duplicated {
+		t.Fatal("wrong stats", stats)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	n := NewNetwork(3)
+	defer n.Close()
+	a, b := newPair(t, n, 500)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+	n.SetLink(0x1, 0x2, LinkParam{Bandwidth: 10000})
+
+	start := time.Now()
+	req := make([]uint8, 1000)
+	resp, code := a.Call(0, 1, 0x2, 1, 5000, req)
+	if code != dcom.SystemOK || len(resp) != len(req) {
+		t.Fatal("call failed", code)
+	}
+	if time.Since(start) < 90*time.Millisecond {
+		t.Fatal("bandwidth not limited", time.Since(start))
+	}
+}
+
+func TestBlockWindow(t *testing.T) {
+	n := NewNetwork(7)
+	defer n.Close()
+	n.SetDefaultLink(LinkParam{Latency: 10 * time.Millisecond})
+	a, b := newPair(t, n, 100)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+	b.Register(0, 2, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return []uint8{uint8(len(req) >> 8), uint8(len(req))}, dcom.SystemOK
+	})
+
+	// 41帧停等传输需要41个往返时间
+	a.SetBlockWindow(1, 8)
+	start := time.Now()
+	resp, code := a.Call(0, 1, 0x2, 2, 5000, make([]uint8, 10000))
+	if code != dcom.SystemOK || (int(resp[0])<<8)+int(resp[1]) != 10000 {
+		t.Fatal("call failed", code, resp)
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Fatal("window not used", time.Since(start))
+	}
+}
+
+func TestBlockWindowLoss(t *testing.T) {
+	n := NewNetwork(8)
+	defer n.Close()
+	n.SetDefaultLink(LinkParam{Loss: 0.1, Reorder: 0.3})
+	a, b := newPair(t, n, 20)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+	a.SetBlockWindow(1, 8)
+	b.SetBlockWindow(1, 4)
+
+	testCalls(t, a, 10, 5000)
+}
@@ -0,0 +1,110 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 重复请求检测和应答缓存模块
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "container/list"
+
+// 缓存节点固定开销.单位:字节
+const gDedupItemOverhead = 64
+
+type tDedupItem struct {
+	key tExchangeKey
+	// 是否在等待服务应答
+	isPending bool
+	data      []uint8
+	code      int
+	// 加入时间.单位:us
+	time int64
+}
+
+// tDedupCache 应答缓存.按加入时间排序,超过会话生存时间或者超过内存上限时淘汰最早的节点
+type tDedupCache struct {
+	items list.List
+	index map[tExchangeKey]*list.Element
+	size  int
+}
+
+// dedupCheck 检查CON帧是否是重复请求
+// 返回true表示是重复请求,已重放应答或者正在等待应答,不需要调用服务
+func (e *Endpoint) dedupCheck(key tExchangeKey) bool {
+	param := e.getParam()
+	if param.DedupCacheSize <= 0 {
+		return false
+	}
+
+	e.dedupMutex.Lock()
+	e.dedupRemoveExpired(param)
+	node, ok := e.dedup.index[key]
+	if ok == false {
+		e.dedupInsert(param, &tDedupItem{key: key, isPending: true, time: e.getTime()})
+		e.dedupMutex.Unlock()
+		return false
+	}
+	item := node.Value.(*tDedupItem)
+	isPending := item.isPending
+	data := item.data
+	code := item.code
+	e.dedupMutex.Unlock()
+
+	if isPending {
+		logInfo("dedup:request is pending.ignore.token:%d src ia:0x%x", key.token, key.ia)
+		return true
+	}
+	logInfo("dedup:replay response.token:%d src ia:0x%x code:0x%x", key.token, key.ia, code)
+	e.sendResponse(key.protocol, key.pipe, key.ia, key.rid, key.token, data, code)
+	return true
+}
+
+// dedupSave 保存应答
+func (e *Endpoint) dedupSave(key tExchangeKey, data []uint8, code int) {
+	param := e.getParam()
+	if param.DedupCacheSize <= 0 {
+		return
+	}
+
+	e.dedupMutex.Lock()
+	defer e.dedupMutex.Unlock()
+
+	if node, ok := e.dedup.index[key]; ok {
+		e.dedupRemove(node)
+	}
+	e.dedupInsert(param, &tDedupItem{key: key, data: data, code: code, time: e.getTime()})
+}
+
+func (e *Endpoint) dedupInsert(param LoadParam, item *tDedupItem) {
+	if e.dedup.index == nil {
+		e.dedup.index = make(map[tExchangeKey]*list.Element)
+	}
+	e.dedup.index[item.key] = e.dedup.items.PushBack(item)
+	e.dedup.size += len(item.data) + gDedupItemOverhead
+
+	for e.dedup.size > param.DedupCacheSize && e.dedup.items.Len() > 1 {
+		logWarn("dedup cache is full.remove oldest item")
+		e.dedupRemove(e.dedup.items.Front())
+	}
+}
+
+func (e *Endpoint) dedupRemove(node *list.Element) {
+	item := node.Value.(*tDedupItem)
+	e.dedup.items.Remove(node)
+	delete(e.dedup.index, item.key)
+	e.dedup.size -= len(item.data) + gDedupItemOverhead
+}
+
+// dedupRemoveExpired 删除超过会话生存时间的节点
+func (e *Endpoint) dedupRemoveExpired(param LoadParam) {
+	lifetime := int64(param.ExchangeLifetime) * 1000
+	if lifetime == 0 {
+		lifetime = int64(param.BlockRetryInterval*param.BlockRetryMaxNum) * 1000
+	}
+	now := e.getTime()
+	for {
+		node := e.dedup.items.Front()
+		if node == nil || now-node.Value.(*tDedupItem).time <= lifetime {
+			return
+		}
+		e.dedupRemove(node)
+	}
+}
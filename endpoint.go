@@ -0,0 +1,210 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 端点模块.每个端点拥有独立的DCOM协议栈
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 端点状态
+const (
+	gEndpointStateIdle = iota
+	gEndpointStateRunning
+	gEndpointStateClosing
+)
+
+// Endpoint DCOM端点
+// 端点拥有独立的服务表,等待队列,块传输收发队列和token分配表.同一进程中可以运行多个端点
+type Endpoint struct {
+	param LoadParam
+	state int
+	// 关闭信号.关闭后运行线程退出
+	quit    chan struct{}
+	threads sync.WaitGroup
+	mutex   sync.RWMutex
+	// 服务处理函数的上下文.关闭时取消
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	services      map[int]HandlerFunc
+	servicesMutex sync.RWMutex
+
+	pipes map[uint64]Pipe
+	// 管道的块传输发送窗口
+	blockWindows map[uint64]int
+	// 上次分配的管道号序号
+	pipeNext   uint64
+	pipesMutex sync.RWMutex
+
+	// 等待队列和块传输收发队列按会话分片索引
+	waitItems    tWaitTable
+	blockTxItems tBlockTxTable
+	blockRxItems tBlockRxTable
+
+	deferItems      map[tExchangeKey]*Responder
+	deferItemsMutex sync.Mutex
+
+	dedup      tDedupCache
+	dedupMutex sync.Mutex
+
+	rttItems      map[tPeerKey]*tRttItem
+	rttItemsMutex sync.Mutex
+
+	scheduler tScheduler
+	// 时钟.启动时从载入参数读取
+	clock Clock
+
+	tokens   tTokenAllocator
+	inflight tInflight
+	outbound tOutbound
+}
+
+// defaultEndpoint 默认端点.包级函数均操作此端点
+var defaultEndpoint = newEndpoint()
+
+// NewEndpoint 创建端点并启动
+func NewEndpoint(param *LoadParam) *Endpoint {
+	e := newEndpoint()
+	e.load(param)
+	return e
+}
+
+func newEndpoint() *Endpoint {
+	e := &Endpoint{}
+	e.services = make(map[int]HandlerFunc)
+	e.pipes = make(map[uint64]Pipe)
+	e.blockWindows = make(map[uint64]int)
+	e.deferItems = make(map[tExchangeKey]*Responder)
+	e.rttItems = make(map[tPeerKey]*tRttItem)
+	e.tokens.items = make(map[tPeerKey]*tTokenPeer)
+	e.inflight.pipes = make(map[uint64]int)
+	e.inflight.peers = make(map[tPeerKey]int)
+	e.inflight.queues = make(map[tPeerKey]*tInflightQueue)
+	e.inflight.pipeQueued = make(map[uint64]int)
+	e.outbound.queues = make(map[uint64]*tOutboundQueue)
+	e.waitItems.init()
+	e.blockTxItems.init()
+	e.blockRxItems.init()
+	e.scheduler.wake = make(chan struct{}, 1)
+	e.clock = gSystemClock
+	return e
+}
+
+// load 载入参数.未运行时启动运行线程,运行中重复载入只更新参数
+func (e *Endpoint) load(param *LoadParam) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.param = *param
+	if e.state == gEndpointStateRunning {
+		logInfo("endpoint is running.update param except clock")
+		return
+	}
+	if e.state == gEndpointStateClosing {
+		logWarn("endpoint is closing.update param only")
+		return
+	}
+	e.state = gEndpointStateRunning
+	e.clock = gSystemClock
+	if param.Clock != nil {
+		e.clock = param.Clock
+	}
+	e.quit = make(chan struct{})
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	e.threads.Add(1)
+	go e.threadSchedulerRun(e.quit)
+}
+
+// getParam 读取载入参数
+func (e *Endpoint) getParam() LoadParam {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.param
+}
+
+// isRunning 是否允许发起新的调用
+func (e *Endpoint) isRunning() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.state == gEndpointStateRunning
+}
+
+// isStopped 运行线程是否已停止.停止后不再处理接收数据
+func (e *Endpoint) isStopped() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.state == gEndpointStateIdle
+}
+
+// Unload 卸载默认端点
+// 关闭后可以再次调用Load载入,已注册的服务保留
+func Unload(ctx context.Context) error {
+	return defaultEndpoint.Close(ctx)
+}
+
+// Close 关闭端点
+// 关闭后不再接受新的调用.等待进行中的调用和块传输完成,直到ctx超时或者取消.
+// 剩余的调用以SystemErrorShutdown结束,最后停止所有运行线程.
+// 返回nil表示所有调用都已正常完成,否则返回ctx的错误
+func (e *Endpoint) Close(ctx context.Context) error {
+	e.mutex.Lock()
+	if e.state != gEndpointStateRunning {
+		e.mutex.Unlock()
+		return nil
+	}
+	e.state = gEndpointStateClosing
+	quit := e.quit
+	cancel := e.cancel
+	e.mutex.Unlock()
+
+	logInfo("endpoint close.wait for pending calls")
+	err := e.waitDrain(ctx)
+	if err != nil {
+		logWarn("endpoint close.drain failed:%v", err)
+	}
+	e.shutdownInflight()
+	e.shutdownWaitItems()
+	e.shutdownDeferItems()
+	e.shutdownBlockTxItems()
+	e.shutdownBlockRxItems()
+	e.shutdownOutbound()
+
+	close(quit)
+	cancel()
+	e.threads.Wait()
+	e.scheduler.clear()
+
+	e.mutex.Lock()
+	e.state = gEndpointStateIdle
+	e.mutex.Unlock()
+	logInfo("endpoint closed")
+	return err
+}
+
+// waitDrain 等待在途排队,等待队列,块传输发送队列和延迟应答清空
+// 按端点时钟每隔1ms检查一次
+func (e *Endpoint) waitDrain(ctx context.Context) error {
+	timer := e.getClock().NewTimer(time.Millisecond)
+	defer timer.Stop()
+	for {
+		if e.isDrained() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+			timer.Reset(time.Millisecond)
+		}
+	}
+}
+
+func (e *Endpoint) isDrained() bool {
+	return e.inflightQueued() == 0 && e.waitItems.len() == 0 && e.blockTxItems.len() == 0 &&
+		e.deferItemsNum() == 0
+}
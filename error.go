@@ -0,0 +1,96 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 错误模块
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "fmt"
+
+// Error DCOM调用错误
+// 可以使用errors.Is与哨兵错误比较,比较时只比较错误码
+type Error struct {
+	// 错误码
+	Code int
+	// 是否是对端通过复位连接帧返回的错误.否则是本地产生的错误
+	IsRemote bool
+	Rid      int
+	Token    int
+	// 对端地址
+	IA uint64
+	// 导致错误的底层错误.比如发送失败时管道返回的错误
+	Cause error
+}
+
+// 哨兵错误
+var (
+	ErrRxTimeout        = &Error{Code: SystemErrorRxTimeout}
+	ErrTxTimeout        = &Error{Code: SystemErrorTxTimeout}
+	ErrNotEnoughMemory  = &Error{Code: SystemErrorNotEnoughMemory}
+	ErrInvalidRid       = &Error{Code: SystemErrorInvalidRid}
+	ErrWrongBlockCheck  = &Error{Code: SystemErrorWrongBlockCheck}
+	ErrWrongBlockOffset = &Error{Code: SystemErrorWrongBlockOffset}
+	ErrParamInvalid     = &Error{Code: SystemErrorParamInvalid}
+	ErrShutdown         = &Error{Code: SystemErrorShutdown}
+	ErrCanceled         = &Error{Code: SystemErrorCanceled}
+	ErrTokenExhausted   = &Error{Code: SystemErrorTokenExhausted}
+	ErrSendFailed       = &Error{Code: SystemErrorSendFailed}
+	ErrPipeClosed       = &Error{Code: SystemErrorPipeClosed}
+)
+
+var errorTexts = map[int]string{
+	SystemOK:                    "ok",
+	SystemErrorRxTimeout:        "rx timeout",
+	SystemErrorTxTimeout:        "tx timeout",
+	SystemErrorNotEnoughMemory:  "not enough memory",
+	SystemErrorInvalidRid:       "invalid rid",
+	SystemErrorWrongBlockCheck:  "wrong block check",
+	SystemErrorWrongBlockOffset: "wrong block offset",
+	SystemErrorParamInvalid:     "param invalid",
+	SystemErrorShutdown:         "shutdown",
+	SystemErrorCanceled:         "canceled",
+	SystemErrorTokenExhausted:   "token exhausted",
+	SystemErrorSendFailed:       "send failed",
+	SystemErrorPipeClosed:       "pipe closed",
+}
+
+// ErrorText 错误码转换为可读文本
+func ErrorText(code int) string {
+	text, ok := errorTexts[code]
+	if ok == false {
+		return fmt.Sprintf("unknown error 0x%x", code)
+	}
+	return text
+}
+
+func (e *Error) Error() string {
+	origin := "local"
+	if e.IsRemote {
+		origin = "remote"
+	}
+	text := fmt.Sprintf("dcom: %s(0x%x) %s rid:%d token:%d ia:0x%x", ErrorText(e.Code), e.Code, origin, e.Rid,
+		e.Token, e.IA)
+	if e.Cause != nil {
+		text += ": " + e.Cause.Error()
+	}
+	return text
+}
+
+// Unwrap 返回底层错误
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is 错误码相同即认为是同一错误
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if ok == false {
+		return false
+	}
+	return e.Code == t.Code
+}
+
+// isTemporary 是否是临时错误.临时错误实现Temporary() bool并返回true
+func isTemporary(err error) bool {
+	t, ok := err.(interface{ Temporary() bool })
+	return ok && t.Temporary()
+}
@@ -1,6 +1,6 @@
 module github.com/jdhxyy/dcom
 
-go 1.12
+go 1.13
 
 require (
 	github.com/jdhxyy/crc16 v0.0.0-20210228220550-7713e2f73123
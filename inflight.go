@@ -0,0 +1,292 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 在途限制模块.限制全局,每个管道和每个对端同时进行的调用数
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// 超过在途上限时的处理策略
+const (
+	// 阻塞调用者直到有空闲名额
+	InflightPolicyBlock = iota
+	// 调用立即返回,请求排队等待空闲名额后发送
+	InflightPolicyQueue
+	// 立即以SystemErrorNotEnoughMemory失败
+	InflightPolicyReject
+)
+
+// InflightInfo 在途调用统计
+type InflightInfo struct {
+	// 全局在途数和排队数
+	Total       int
+	TotalQueued int
+	// 管道在途数和排队数
+	Pipe       int
+	PipeQueued int
+	// 对端在途数和排队数
+	Peer       int
+	PeerQueued int
+}
+
+// tInflightWaiter 等待名额的调用
+type tInflightWaiter struct {
+	pipe  uint64
+	ia    uint64
+	ready chan struct{}
+	// 优先级.值越大越先分配名额
+	priority int
+	// 等待结果.名额分配成功为SystemOK
+	result int
+	queue  *tInflightQueue
+	node   *list.Element
+}
+
+// tInflightQueue 对端的等待队列.按优先级从高到低排列,同优先级按排队顺序
+type tInflightQueue struct {
+	key     tPeerKey
+	waiters list.List
+	// 在就绪列表中的节点
+	node *list.Element
+}
+
+// tInflight 在途统计和等待队列
+type tInflight struct {
+	total  int
+	pipes  map[uint64]int
+	peers  map[tPeerKey]int
+	queues map[tPeerKey]*tInflightQueue
+	// 有等待者的对端队列.对端唤醒一个等待者后移到末尾
+	ready list.List
+	// 全局和每个管道的排队数
+	queued     int
+	pipeQueued map[uint64]int
+	mutex      sync.Mutex
+}
+
+// isAllow 是否还有空闲名额.调用者需持有锁
+func (f *tInflight) isAllow(param *LoadParam, pipe uint64, ia uint64) bool {
+	if param.MaxInflight > 0 && f.total >= param.MaxInflight {
+		return false
+	}
+	if param.MaxInflightPerPipe > 0 && f.pipes[pipe] >= param.MaxInflightPerPipe {
+		return false
+	}
+	if param.MaxInflightPerPeer > 0 && f.peers[tPeerKey{pipe: pipe, ia: ia}] >= param.MaxInflightPerPeer {
+		return false
+	}
+	return true
+}
+
+// add 占用名额.调用者需持有锁
+func (f *tInflight) add(pipe uint64, ia uint64) {
+	f.total++
+	f.pipes[pipe]++
+	f.peers[tPeerKey{pipe: pipe, ia: ia}]++
+}
+
+// inflightAcquire 申请在途名额
+// 有空闲名额时返回nil.没有名额时按策略拒绝或者返回等待者,由调用者通过inflightWait等待
+func (e *Endpoint) inflightAcquire(pipe uint64, ia uint64, priority int) (*tInflightWaiter, int) {
+	param := e.getParam()
+
+	e.inflight.mutex.Lock()
+	defer e.inflight.mutex.Unlock()
+
+	// 同一对端已有排队的调用时新调用也排队,保证先来先发
+	key := tPeerKey{pipe: pipe, ia: ia}
+	_, isQueued := e.inflight.queues[key]
+	if isQueued == false && e.inflight.isAllow(&param, pipe, ia) {
+		e.inflight.add(pipe, ia)
+		return nil, SystemOK
+	}
+	if param.InflightPolicy == InflightPolicyReject {
+		logWarn("inflight limit reached!reject.pipe:0x%x ia:0x%x", pipe, ia)
+		return nil, SystemErrorNotEnoughMemory
+	}
+
+	waiter := &tInflightWaiter{pipe: pipe, ia: ia, priority: priority, ready: make(chan struct{})}
+	e.inflight.push(waiter)
+	logInfo("inflight limit reached!wait.pipe:0x%x ia:0x%x queued:%d", pipe, ia, e.inflight.queued)
+	return waiter, SystemOK
+}
+
+// push 等待者按优先级加入对端队列.对端第一个等待者同时把队列加入就绪列表.调用者需持有锁
+func (f *tInflight) push(waiter *tInflightWaiter) {
+	key := tPeerKey{pipe: waiter.pipe, ia: waiter.ia}
+	q, ok := f.queues[key]
+	if ok == false {
+		q = &tInflightQueue{key: key}
+		q.node = f.ready.PushBack(q)
+		f.queues[key] = q
+	}
+	waiter.queue = q
+	waiter.node = nil
+	for node := q.waiters.Back(); node != nil; node = node.Prev() {
+		if node.Value.(*tInflightWaiter).priority >= waiter.priority {
+			waiter.node = q.waiters.InsertAfter(waiter, node)
+			break
+		}
+	}
+	if waiter.node == nil {
+		waiter.node = q.waiters.PushFront(waiter)
+	}
+	f.queued++
+	f.pipeQueued[waiter.pipe]++
+}
+
+// remove 等待者移出对端队列.队列为空时从就绪列表删除.调用者需持有锁
+func (f *tInflight) remove(waiter *tInflightWaiter) {
+	q := waiter.queue
+	q.waiters.Remove(waiter.node)
+	waiter.node = nil
+	waiter.queue = nil
+	f.queued--
+	f.pipeQueued[waiter.pipe]--
+	if f.pipeQueued[waiter.pipe] <= 0 {
+		delete(f.pipeQueued, waiter.pipe)
+	}
+	if q.waiters.Len() == 0 {
+		f.ready.Remove(q.node)
+		delete(f.queues, q.key)
+	}
+}
+
+// inflightWait 等待名额
+// timeoutUs是最长等待时间.单位:us.返回SystemOK表示已占用名额
+func (e *Endpoint) inflightWait(ctx context.Context, waiter *tInflightWaiter, timeoutUs int64) int {
+	var timeout <-chan time.Time
+	if timeoutUs < gTimeMax {
+		timer := e.getClock().NewTimer(time.Duration(timeoutUs) * time.Microsecond)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	result := SystemOK
+	select {
+	case <-waiter.ready:
+		return waiter.result
+	case <-ctx.Done():
+		result = contextErrorCode(ctx.Err())
+	case <-timeout:
+		result = SystemErrorRxTimeout
+	}
+
+	e.inflight.mutex.Lock()
+	if waiter.node != nil {
+		e.inflight.remove(waiter)
+		e.inflight.mutex.Unlock()
+		return result
+	}
+	e.inflight.mutex.Unlock()
+
+	// 已分配名额则归还
+	<-waiter.ready
+	if waiter.result == SystemOK {
+		e.inflightRelease(waiter.pipe, waiter.ia)
+	}
+	return result
+}
+
+// inflightRelease 归还名额并唤醒可以发送的等待者
+func (e *Endpoint) inflightRelease(pipe uint64, ia uint64) {
+	e.inflight.mutex.Lock()
+	defer e.inflight.mutex.Unlock()
+
+	key := tPeerKey{pipe: pipe, ia: ia}
+	e.inflight.total--
+	e.inflight.pipes[pipe]--
+	if e.inflight.pipes[pipe] <= 0 {
+		delete(e.inflight.pipes, pipe)
+	}
+	e.inflight.peers[key]--
+	if e.inflight.peers[key] <= 0 {
+		delete(e.inflight.peers, key)
+	}
+	e.inflightWake()
+}
+
+// inflightWake 唤醒可以发送的等待者.调用者需持有锁
+// 只检查有等待者的对端的队首,每次唤醒优先级最高的队首.优先级相同时对端轮流分配名额
+func (e *Endpoint) inflightWake() {
+	param := e.getParam()
+
+	for {
+		if param.MaxInflight > 0 && e.inflight.total >= param.MaxInflight {
+			return
+		}
+		var best *tInflightWaiter
+		for node := e.inflight.ready.Front(); node != nil; node = node.Next() {
+			q := node.Value.(*tInflightQueue)
+			if e.inflight.isAllow(&param, q.key.pipe, q.key.ia) == false {
+				continue
+			}
+			waiter := q.waiters.Front().Value.(*tInflightWaiter)
+			if best == nil || waiter.priority > best.priority {
+				best = waiter
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		// 唤醒后对端移到就绪列表末尾
+		q := best.queue
+		e.inflight.remove(best)
+		if q.waiters.Len() > 0 {
+			e.inflight.ready.MoveToBack(q.node)
+		}
+		e.inflight.add(best.pipe, best.ia)
+		best.result = SystemOK
+		close(best.ready)
+	}
+}
+
+// inflightQueued 排队的调用数
+func (e *Endpoint) inflightQueued() int {
+	e.inflight.mutex.Lock()
+	defer e.inflight.mutex.Unlock()
+	return e.inflight.queued
+}
+
+// shutdownInflight 以关闭错误码结束所有排队的调用
+func (e *Endpoint) shutdownInflight() {
+	e.inflight.mutex.Lock()
+	defer e.inflight.mutex.Unlock()
+
+	for node := e.inflight.ready.Front(); node != nil; node = e.inflight.ready.Front() {
+		q := node.Value.(*tInflightQueue)
+		waiter := q.waiters.Front().Value.(*tInflightWaiter)
+		e.inflight.remove(waiter)
+		waiter.result = SystemErrorShutdown
+		close(waiter.ready)
+	}
+}
+
+// InflightState 读取默认端点的在途调用统计
+func InflightState(pipe uint64, ia uint64) InflightInfo {
+	return defaultEndpoint.InflightState(pipe, ia)
+}
+
+// InflightState 读取在途调用统计.统计包括全局,指定管道和指定对端
+func (e *Endpoint) InflightState(pipe uint64, ia uint64) InflightInfo {
+	e.inflight.mutex.Lock()
+	defer e.inflight.mutex.Unlock()
+
+	var info InflightInfo
+	key := tPeerKey{pipe: pipe, ia: ia}
+	info.Total = e.inflight.total
+	info.Pipe = e.inflight.pipes[pipe]
+	info.Peer = e.inflight.peers[key]
+	info.TotalQueued = e.inflight.queued
+	info.PipeQueued = e.inflight.pipeQueued[pipe]
+	if q, ok := e.inflight.queues[key]; ok {
+		info.PeerQueued = q.waiters.Len()
+	}
+	return info
+}
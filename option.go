@@ -0,0 +1,68 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 调用选项模块
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "time"
+
+// CallOption 调用选项
+type CallOption func(opts *tCallOptions)
+
+type tCallOptions struct {
+	// 重传最大次数.含义同LoadParam.BlockRetryMaxNum
+	retryMaxNum int
+	// 重传间隔.单位:us.为0时使用LoadParam.BlockRetryInterval或者自适应重传超时
+	retryInterval int64
+	// 是否不需要应答
+	isNon bool
+	// 优先级.值越大越优先处理
+	priority int
+}
+
+// WithRetries 设置重传最大次数.含义同LoadParam.BlockRetryMaxNum
+func WithRetries(n int) CallOption {
+	return func(opts *tCallOptions) {
+		opts.retryMaxNum = n
+	}
+}
+
+// WithRetryInterval 设置固定的重传间隔.设置后不使用自适应重传超时
+func WithRetryInterval(d time.Duration) CallOption {
+	return func(opts *tCallOptions) {
+		opts.retryInterval = int64(d / time.Microsecond)
+	}
+}
+
+// WithNonConfirmable 发送NON帧,不需要应答
+func WithNonConfirmable() CallOption {
+	return func(opts *tCallOptions) {
+		opts.isNon = true
+	}
+}
+
+// WithPriority 设置优先级,默认为0
+// 值越大越先分配在途名额,越先从管道发送队列发送,同时到期的重传和超时越先处理
+func WithPriority(p int) CallOption {
+	return func(opts *tCallOptions) {
+		opts.priority = p
+	}
+}
+
+// newCallOptions 创建调用选项.未设置的选项使用载入参数
+func newCallOptions(param *LoadParam, options []CallOption) *tCallOptions {
+	var opts tCallOptions
+	opts.retryMaxNum = param.BlockRetryMaxNum
+	for _, option := range options {
+		option(&opts)
+	}
+	return &opts
+}
+
+// optionRetryInterval 计算第retryNum次重传的间隔.单位:us
+func (e *Endpoint) optionRetryInterval(opts *tCallOptions, pipe uint64, ia uint64, retryNum int) int64 {
+	if opts.retryInterval > 0 {
+		return opts.retryInterval
+	}
+	return e.retryInterval(pipe, ia, retryNum)
+}
@@ -0,0 +1,239 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 发送队列模块.管道不允许发送时缓存帧,管道就绪后按顺序发送
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// tOutboundFrame 缓存的帧
+type tOutboundFrame struct {
+	protocol int
+	dstIA    uint64
+	bytes    []uint8
+	// 优先级.值越大越先发送
+	priority int
+	// 帧所属的请求或者块传输.不为nil时请求结束后不再发送
+	key     *tBlockKey
+	isBlock bool
+}
+
+// tOutboundQueue 管道发送队列.按优先级从高到低排列,同优先级按入队顺序
+type tOutboundQueue struct {
+	frames list.List
+	// 是否正在发送队列中的帧.发送期间新帧也需入队,保证顺序
+	isFlushing bool
+}
+
+// tOutbound 所有管道的发送队列
+type tOutbound struct {
+	queues map[uint64]*tOutboundQueue
+	mutex  sync.Mutex
+}
+
+// transmit 发送字节流.返回管道的发送错误
+// 未开启发送队列时,管道不允许发送则丢弃.开启后按优先级缓存到管道发送队列
+func (e *Endpoint) transmit(protocol int, pipe uint64, dstIA uint64, bytes []uint8, priority int) error {
+	param := e.getParam()
+	if param.OutboundQueueSize <= 0 {
+		if e.pipeAllowSend(pipe) == false {
+			logWarn("send failed!pipe:0x%x is not allow send", pipe)
+			return nil
+		}
+		return e.pipeSend(protocol, pipe, dstIA, bytes)
+	}
+
+	e.outbound.mutex.Lock()
+	q, ok := e.outbound.queues[pipe]
+	if ok == false || (q.frames.Len() == 0 && q.isFlushing == false) {
+		e.outbound.mutex.Unlock()
+		if e.pipeAllowSend(pipe) {
+			return e.pipeSend(protocol, pipe, dstIA, bytes)
+		}
+		e.outbound.mutex.Lock()
+		q, ok = e.outbound.queues[pipe]
+		if ok == false {
+			q = &tOutboundQueue{}
+			e.outbound.queues[pipe] = q
+		}
+	}
+	// 重传的帧已在队列中则不再入队,避免重传挤出其他帧
+	if q.find(protocol, dstIA, bytes) {
+		logInfo("frame is already queued.pipe:0x%x", pipe)
+		e.outbound.mutex.Unlock()
+		return nil
+	}
+	frame := &tOutboundFrame{protocol: protocol, dstIA: dstIA, bytes: bytes, priority: priority}
+	frame.key, frame.isBlock = outboundFrameKey(protocol, pipe, dstIA, bytes)
+	if q.frames.Len() >= param.OutboundQueueSize {
+		oldest := q.lowest()
+		if oldest.Value.(*tOutboundFrame).priority > priority {
+			logWarn("outbound queue is full!drop frame.pipe:0x%x priority:%d", pipe, priority)
+			e.outbound.mutex.Unlock()
+			return nil
+		}
+		logWarn("outbound queue is full!drop oldest frame.pipe:0x%x", pipe)
+		q.frames.Remove(oldest)
+	}
+	q.insert(frame)
+	logInfo("pipe:0x%x is not allow send.frame queued:%d", pipe, q.frames.Len())
+	e.outbound.mutex.Unlock()
+
+	// 入队期间管道可能已经就绪
+	e.outboundFlush(pipe)
+	return nil
+}
+
+// find 队列中是否有相同的帧.调用者需持有锁
+func (q *tOutboundQueue) find(protocol int, dstIA uint64, data []uint8) bool {
+	for node := q.frames.Front(); node != nil; node = node.Next() {
+		frame := node.Value.(*tOutboundFrame)
+		if frame.protocol == protocol && frame.dstIA == dstIA && bytes.Equal(frame.bytes, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundFrameKey 读取帧所属的会话.只有CON请求和块传输的帧有会话,其他帧返回nil
+func outboundFrameKey(protocol int, pipe uint64, dstIA uint64, bytes []uint8) (*tBlockKey, bool) {
+	word := gBytesToControlWord(bytes)
+	if word == nil || (word.blockFlag == 0 && word.code != gCodeCon) {
+		return nil, false
+	}
+	key := tBlockKey{tExchangeKey: tExchangeKey{protocol: protocol, pipe: pipe, ia: dstIA, rid: word.rid,
+		token: word.token}, code: word.code}
+	return &key, word.blockFlag == 1
+}
+
+// outboundIsAlive 帧所属的会话是否还在进行.会话已结束的帧不需要发送
+func (e *Endpoint) outboundIsAlive(frame *tOutboundFrame) bool {
+	if frame.key == nil {
+		return true
+	}
+	if frame.isBlock {
+		sh := e.blockTxItems.shard(&frame.key.tExchangeKey)
+		sh.mutex.Lock()
+		_, ok := sh.items[*frame.key]
+		sh.mutex.Unlock()
+		return ok
+	}
+	sh := e.waitItems.shard(&frame.key.tExchangeKey)
+	sh.mutex.Lock()
+	_, ok := sh.items[frame.key.tExchangeKey]
+	sh.mutex.Unlock()
+	return ok
+}
+
+// insert 按优先级插入帧.同优先级的帧排在后面.调用者需持有锁
+func (q *tOutboundQueue) insert(frame *tOutboundFrame) {
+	for node := q.frames.Back(); node != nil; node = node.Prev() {
+		if node.Value.(*tOutboundFrame).priority >= frame.priority {
+			q.frames.InsertAfter(frame, node)
+			return
+		}
+	}
+	q.frames.PushFront(frame)
+}
+
+// lowest 最低优先级中最早入队的帧.队列不能为空.调用者需持有锁
+func (q *tOutboundQueue) lowest() *list.Element {
+	node := q.frames.Back()
+	priority := node.Value.(*tOutboundFrame).priority
+	for node.Prev() != nil && node.Prev().Value.(*tOutboundFrame).priority == priority {
+		node = node.Prev()
+	}
+	return node
+}
+
+// outboundFlush 按顺序发送管道队列中的帧,直到队列为空或者管道不允许发送
+// 所属会话已结束的帧直接丢弃.队列中的帧发送失败只记录日志,由重传处理
+func (e *Endpoint) outboundFlush(pipe uint64) {
+	e.outbound.mutex.Lock()
+	q, ok := e.outbound.queues[pipe]
+	if ok == false || q.isFlushing {
+		e.outbound.mutex.Unlock()
+		return
+	}
+	q.isFlushing = true
+	e.outbound.mutex.Unlock()
+
+	for {
+		isAllow := e.pipeAllowSend(pipe)
+
+		e.outbound.mutex.Lock()
+		if isAllow == false || q.frames.Len() == 0 {
+			q.isFlushing = false
+			if q.frames.Len() == 0 {
+				delete(e.outbound.queues, pipe)
+			}
+			e.outbound.mutex.Unlock()
+			return
+		}
+		frame := q.frames.Remove(q.frames.Front()).(*tOutboundFrame)
+		e.outbound.mutex.Unlock()
+
+		if e.outboundIsAlive(frame) == false {
+			logInfo("exchange is finished!drop queued frame.pipe:0x%x token:%d", pipe, frame.key.token)
+			continue
+		}
+		_ = e.pipeSend(frame.protocol, pipe, frame.dstIA, frame.bytes)
+	}
+}
+
+// outboundQueueLen 管道发送队列中的帧数
+func (e *Endpoint) outboundQueueLen(pipe uint64) int {
+	e.outbound.mutex.Lock()
+	defer e.outbound.mutex.Unlock()
+
+	q, ok := e.outbound.queues[pipe]
+	if ok == false {
+		return 0
+	}
+	return q.frames.Len()
+}
+
+// teardownOutbound 清空管道的发送队列
+func (e *Endpoint) teardownOutbound(pipe uint64) {
+	e.outbound.mutex.Lock()
+	defer e.outbound.mutex.Unlock()
+
+	q, ok := e.outbound.queues[pipe]
+	if ok == false {
+		return
+	}
+	if q.isFlushing == false {
+		delete(e.outbound.queues, pipe)
+		return
+	}
+	q.frames.Init()
+}
+
+// shutdownOutbound 清空所有发送队列
+func (e *Endpoint) shutdownOutbound() {
+	e.outbound.mutex.Lock()
+	defer e.outbound.mutex.Unlock()
+
+	for pipe, q := range e.outbound.queues {
+		if q.isFlushing == false {
+			delete(e.outbound.queues, pipe)
+			continue
+		}
+		q.frames.Init()
+	}
+}
+
+// NotifyPipeReady 通知默认端点管道可以发送
+func NotifyPipeReady(pipe uint64) {
+	defaultEndpoint.NotifyPipeReady(pipe)
+}
+
+// NotifyPipeReady 通知管道可以发送.发送队列中缓存的帧按顺序发送
+func (e *Endpoint) NotifyPipeReady(pipe uint64) {
+	logInfo("pipe:0x%x ready.queued:%d", pipe, e.outboundQueueLen(pipe))
+	e.outboundFlush(pipe)
+}
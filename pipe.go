@@ -0,0 +1,207 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 管道模块.管道对象在运行时注册和移除,每个管道有独立的MTU和发送接口
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "errors"
+
+// errPipeNotExist 管道不存在
+var errPipeNotExist = errors.New("dcom: pipe not exist")
+
+// Pipe 管道
+type Pipe interface {
+	// ID 管道号
+	ID() uint64
+	// MTU 单帧最大字节数,包括控制字.小于等于0时使用默认值
+	MTU() int
+	// Send 发送DCOM协议数据
+	Send(protocol int, dstIA uint64, bytes []uint8) error
+	// AllowSend 是否允许发送
+	AllowSend() bool
+	// Close 关闭管道.从端点移除时调用
+	Close() error
+}
+
+// ReceiveFunc 管道接收函数类型.管道接收到DCOM协议数据后调用
+type ReceiveFunc func(protocol int, srcIA uint64, bytes []uint8)
+
+// 管道MTU的最小值.至少能容纳块传输帧的控制字,块传输头部和1个字节载荷
+const gPipeMtuMin = gControlWordLen + gBlockHeaderLen + 1
+
+// 端点分配的管道号最高位为1,与IPv4编码的管道号和应用指定的管道号区分
+const gPipeAllocFlag = uint64(1) << 63
+
+// AddPipe 向默认端点添加管道
+func AddPipe(pipe Pipe) (ReceiveFunc, error) {
+	return defaultEndpoint.AddPipe(pipe)
+}
+
+// AddPipe 添加管道
+// 返回绑定到此管道的接收函数.管道号已存在或者MTU太小时返回ErrParamInvalid
+func (e *Endpoint) AddPipe(pipe Pipe) (ReceiveFunc, error) {
+	id := pipe.ID()
+	mtu := pipe.MTU()
+	if mtu > 0 && mtu < gPipeMtuMin {
+		logWarn("add pipe failed!mtu is too small:%d.pipe:0x%x", mtu, id)
+		return nil, ErrParamInvalid
+	}
+
+	e.pipesMutex.Lock()
+	defer e.pipesMutex.Unlock()
+
+	if _, ok := e.pipes[id]; ok {
+		logWarn("add pipe failed!pipe is exist:0x%x", id)
+		return nil, ErrParamInvalid
+	}
+	e.pipes[id] = pipe
+	logInfo("add pipe:0x%x mtu:%d", id, mtu)
+
+	return func(protocol int, srcIA uint64, bytes []uint8) {
+		if e.getPipe(id) != pipe {
+			logWarn("receive data failed!pipe is removed:0x%x", id)
+			return
+		}
+		e.Receive(protocol, id, srcIA, bytes)
+	}, nil
+}
+
+// AllocPipeID 从默认端点分配管道号
+func AllocPipeID() uint64 {
+	return defaultEndpoint.AllocPipeID()
+}
+
+// AllocPipeID 分配管道号
+// 管道号最高位为1,端点内唯一且跳过已添加的管道号.传输层和PipeTable为没有固定编号的对端分配管道号时使用
+func (e *Endpoint) AllocPipeID() uint64 {
+	e.pipesMutex.Lock()
+	defer e.pipesMutex.Unlock()
+
+	for {
+		e.pipeNext++
+		id := gPipeAllocFlag | e.pipeNext
+		if _, ok := e.pipes[id]; ok == false {
+			return id
+		}
+	}
+}
+
+// RemovePipe 从默认端点移除管道
+func RemovePipe(id uint64) error {
+	return defaultEndpoint.RemovePipe(id)
+}
+
+// RemovePipe 移除并关闭管道
+// 管道上等待应答的调用以SystemErrorPipeClosed结束,块传输收发任务和发送队列中的帧删除.
+// 未完成的延迟应答结束,之后应答返回错误码为SystemErrorPipeClosed的*Error
+func (e *Endpoint) RemovePipe(id uint64) error {
+	e.pipesMutex.Lock()
+	pipe, ok := e.pipes[id]
+	if ok == false {
+		e.pipesMutex.Unlock()
+		return nil
+	}
+	delete(e.pipes, id)
+	e.pipesMutex.Unlock()
+
+	logInfo("remove pipe:0x%x", id)
+	err := pipe.Close()
+	e.teardownPipe(id)
+	return err
+}
+
+// teardownPipe 结束管道上所有进行中的调用,块传输和延迟应答,清空管道的发送队列
+func (e *Endpoint) teardownPipe(pipe uint64) {
+	e.teardownOutbound(pipe)
+	e.teardownDeferItems(pipe)
+
+	var keys []tExchangeKey
+	for i := range e.waitItems.shards {
+		sh := &e.waitItems.shards[i]
+		sh.mutex.Lock()
+		for key := range sh.items {
+			if key.pipe == pipe {
+				keys = append(keys, key)
+			}
+		}
+		sh.mutex.Unlock()
+	}
+	for i := range keys {
+		e.failWaitItem(&keys[i], SystemErrorPipeClosed, nil)
+	}
+
+	for i := range e.blockTxItems.shards {
+		sh := &e.blockTxItems.shards[i]
+		sh.mutex.Lock()
+		for key, item := range sh.items {
+			if key.pipe == pipe {
+				e.blockTxItemsRemove(sh, item)
+			}
+		}
+		sh.mutex.Unlock()
+	}
+	for i := range e.blockRxItems.shards {
+		sh := &e.blockRxItems.shards[i]
+		sh.mutex.Lock()
+		for key, item := range sh.items {
+			if key.pipe == pipe {
+				e.blockRxItemsRemove(sh, item)
+			}
+		}
+		sh.mutex.Unlock()
+	}
+}
+
+// getPipe 读取管道.不存在时返回nil
+func (e *Endpoint) getPipe(id uint64) Pipe {
+	e.pipesMutex.RLock()
+	defer e.pipesMutex.RUnlock()
+	return e.pipes[id]
+}
+
+// pipeAllowSend 管道是否允许发送.没有注册的管道使用载入参数中的接口
+// 没有接口时允许发送,由pipeSend返回管道不存在错误
+func (e *Endpoint) pipeAllowSend(pipe uint64) bool {
+	p := e.getPipe(pipe)
+	if p != nil {
+		return p.AllowSend()
+	}
+	param := e.getParam()
+	if param.IsAllowSend == nil {
+		return true
+	}
+	return param.IsAllowSend(pipe)
+}
+
+// pipeSend 通过管道发送.没有注册的管道使用载入参数中的接口
+func (e *Endpoint) pipeSend(protocol int, pipe uint64, dstIA uint64, bytes []uint8) error {
+	var err error
+	p := e.getPipe(pipe)
+	param := e.getParam()
+	if p != nil {
+		err = p.Send(protocol, dstIA, bytes)
+	} else if param.SendWithError != nil {
+		err = param.SendWithError(protocol, pipe, dstIA, bytes)
+	} else if param.Send != nil {
+		param.Send(protocol, pipe, dstIA, bytes)
+	} else {
+		err = errPipeNotExist
+	}
+	if err != nil {
+		logWarn("pipe:0x%x send failed:%v", pipe, err)
+	}
+	return err
+}
+
+// frameSizeMax 管道单帧最大载荷字节数.超过此字节数需要块传输
+func (e *Endpoint) frameSizeMax(pipe uint64) int {
+	p := e.getPipe(pipe)
+	if p == nil {
+		return gSingleFrameSizeMax
+	}
+	size := p.MTU() - gControlWordLen
+	if size <= 0 || size > gSingleFrameSizeMax {
+		return gSingleFrameSizeMax
+	}
+	return size
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 管道地址表.为任意网络地址分配稳定的管道号
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"net"
+	"sync"
+)
+
+// PipeTable 管道地址表
+// 支持IPv6,带zone的地址和Unix套接字等任意net.Addr.同一地址始终得到相同的管道号
+// 管道号由端点的AllocPipeID分配,同一端点的多个地址表和传输层分配的管道号不会冲突
+type PipeTable struct {
+	e *Endpoint
+	// 兼容模式.IPv4的UDP地址使用AddrToPipe编码
+	isIPv4Compat bool
+	pipes        map[string]uint64
+	addrs        map[uint64]net.Addr
+	mutex        sync.Mutex
+}
+
+// NewPipeTable 为默认端点创建管道地址表
+func NewPipeTable(isIPv4Compat bool) *PipeTable {
+	return defaultEndpoint.NewPipeTable(isIPv4Compat)
+}
+
+// NewPipeTable 创建管道地址表
+// isIPv4Compat为true时IPv4的UDP地址按AddrToPipe的规则编码,与旧版本管道号兼容
+func (e *Endpoint) NewPipeTable(isIPv4Compat bool) *PipeTable {
+	t := &PipeTable{e: e, isIPv4Compat: isIPv4Compat}
+	t.pipes = make(map[string]uint64)
+	t.addrs = make(map[uint64]net.Addr)
+	return t
+}
+
+// Pipe 地址转换为管道号.地址不在表中时分配新的管道号
+func (t *PipeTable) Pipe(addr net.Addr) uint64 {
+	if t.isIPv4Compat {
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr.Zone == "" {
+			if pipe, ok := UDPAddrToPipe(udpAddr); ok {
+				return pipe
+			}
+		}
+	}
+
+	key := addr.Network() + "/" + addr.String()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if pipe, ok := t.pipes[key]; ok {
+		return pipe
+	}
+	pipe := t.e.AllocPipeID()
+	t.pipes[key] = pipe
+	t.addrs[pipe] = addr
+	return pipe
+}
+
+// Addr 管道号转换为地址.管道号不存在时返回false
+func (t *PipeTable) Addr(pipe uint64) (net.Addr, bool) {
+	if t.isIPv4Compat && pipe&gPipeAllocFlag == 0 {
+		return PipeToAddr(pipe), true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	addr, ok := t.addrs[pipe]
+	return addr, ok
+}
+
+// Remove 删除管道号.删除后同一地址会分配新的管道号
+func (t *PipeTable) Remove(pipe uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	addr, ok := t.addrs[pipe]
+	if ok == false {
+		return
+	}
+	delete(t.addrs, pipe)
+	delete(t.pipes, addr.Network()+"/"+addr.String())
+}
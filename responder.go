@@ -0,0 +1,170 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 延迟应答模块
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "context"
+
+// tExchangeKey 会话关键字
+type tExchangeKey struct {
+	protocol int
+	pipe     uint64
+	ia       uint64
+	rid      int
+	token    int
+}
+
+// Responder 延迟应答
+// 服务处理函数调用ResponseWriter.Defer后返回,之后通过Responder完成应答.
+// 超过LoadParam.DeferTimeout未应答时框架向对端发送复位连接帧
+type Responder struct {
+	e   *Endpoint
+	key tExchangeKey
+	// NON帧不需要应答
+	isNon bool
+	// 结束原因.nil表示未结束
+	err   error
+	timer *tTimer
+	// 取消请求的上下文
+	cancel context.CancelFunc
+}
+
+// Ack 应答数据.超过单帧长度时启动块传输
+// 发送失败时返回错误码为SystemErrorSendFailed的*Error
+func (r *Responder) Ack(data []uint8) error {
+	if r.isNon {
+		r.cancel()
+		return nil
+	}
+	if r.finish(nil) == false {
+		return r.err
+	}
+	return r.sendError(r.e.respond(r.key.protocol, r.key.pipe, r.key.ia, r.key.rid, r.key.token, data, SystemOK))
+}
+
+// Rst 应答错误码.对端收到复位连接帧
+// 发送失败时返回错误码为SystemErrorSendFailed的*Error
+func (r *Responder) Rst(code int) error {
+	if r.isNon {
+		r.cancel()
+		return nil
+	}
+	if r.finish(nil) == false {
+		return r.err
+	}
+	return r.sendError(r.e.respond(r.key.protocol, r.key.pipe, r.key.ia, r.key.rid, r.key.token, nil, code))
+}
+
+// sendError 发送错误转换为*Error
+func (r *Responder) sendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: SystemErrorSendFailed, Rid: r.key.rid, Token: r.key.token, IA: r.key.ia, Cause: err}
+}
+
+// finish 结束延迟应答
+// 返回false表示已经结束过
+func (r *Responder) finish(err error) bool {
+	r.e.deferItemsMutex.Lock()
+	defer r.e.deferItemsMutex.Unlock()
+
+	if r.err != nil {
+		return false
+	}
+	if err == nil {
+		// 应答后再次应答返回参数错误
+		err = &Error{Code: SystemErrorParamInvalid, Rid: r.key.rid, Token: r.key.token, IA: r.key.ia}
+	}
+	r.err = err
+	delete(r.e.deferItems, r.key)
+	r.e.scheduler.cancel(r.timer)
+	r.cancel()
+	return true
+}
+
+// deferResponse 创建延迟应答并加入延迟应答表
+func (e *Endpoint) deferResponse(key tExchangeKey, cancel context.CancelFunc) *Responder {
+	r := &Responder{e: e, key: key, cancel: cancel}
+	r.timer = newTimer(0, func() {
+		e.deferItemTimeout(r)
+	})
+
+	e.deferItemsMutex.Lock()
+	e.deferItems[key] = r
+	e.deferItemsMutex.Unlock()
+	e.scheduler.schedule(r.timer, e.getTime()+e.deferTimeout())
+	logInfo("defer response.token:%d src ia:0x%x rid:%d", key.token, key.ia, key.rid)
+	return r
+}
+
+// isDeferPending 会话是否在等待延迟应答
+func (e *Endpoint) isDeferPending(key tExchangeKey) bool {
+	e.deferItemsMutex.Lock()
+	defer e.deferItemsMutex.Unlock()
+	_, ok := e.deferItems[key]
+	return ok
+}
+
+// deferTimeout 延迟应答超时时间.单位:us
+func (e *Endpoint) deferTimeout() int64 {
+	param := e.getParam()
+	timeoutUs := int64(param.DeferTimeout) * 1000
+	if timeoutUs == 0 {
+		// 默认为对端重传总时间的一半,保证复位连接帧在对端放弃之前到达
+		timeoutUs = int64(param.BlockRetryInterval*param.BlockRetryMaxNum) * 1000 / 2
+	}
+	return timeoutUs
+}
+
+// deferItemTimeout 延迟应答超时处理.向对端发送复位连接帧
+func (e *Endpoint) deferItemTimeout(r *Responder) {
+	if r.finish(&Error{Code: SystemErrorTxTimeout, Rid: r.key.rid, Token: r.key.token, IA: r.key.ia}) {
+		logWarn("defer response timeout!send rst.token:%d src ia:0x%x", r.key.token, r.key.ia)
+		// 缓存复位连接帧,对端重传的请求会收到同样的复位
+		e.respond(r.key.protocol, r.key.pipe, r.key.ia, r.key.rid, r.key.token, nil, SystemErrorTxTimeout)
+	}
+}
+
+// deferItemsNum 未完成的延迟应答数
+func (e *Endpoint) deferItemsNum() int {
+	e.deferItemsMutex.Lock()
+	defer e.deferItemsMutex.Unlock()
+	return len(e.deferItems)
+}
+
+// teardownDeferItems 以管道关闭错误码结束管道上的延迟应答.管道已移除,不发送复位连接帧
+func (e *Endpoint) teardownDeferItems(pipe uint64) {
+	var items []*Responder
+	e.deferItemsMutex.Lock()
+	for key, r := range e.deferItems {
+		if key.pipe == pipe {
+			items = append(items, r)
+		}
+	}
+	e.deferItemsMutex.Unlock()
+
+	for _, r := range items {
+		if r.finish(&Error{Code: SystemErrorPipeClosed, Rid: r.key.rid, Token: r.key.token, IA: r.key.ia}) {
+			logWarn("pipe closed!defer response failed.token:%d pipe:0x%x", r.key.token, pipe)
+		}
+	}
+}
+
+// shutdownDeferItems 以关闭错误码结束所有延迟应答
+func (e *Endpoint) shutdownDeferItems() {
+	var items []*Responder
+	e.deferItemsMutex.Lock()
+	for _, r := range e.deferItems {
+		items = append(items, r)
+	}
+	e.deferItemsMutex.Unlock()
+
+	for _, r := range items {
+		if r.finish(&Error{Code: SystemErrorShutdown, Rid: r.key.rid, Token: r.key.token, IA: r.key.ia}) {
+			logWarn("endpoint shutdown!defer response failed.token:%d", r.key.token)
+			e.sendRstFrame(r.key.protocol, r.key.pipe, r.key.ia, SystemErrorShutdown, r.key.rid, r.key.token)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 往返时间估计模块.按管道和对端地址估计往返时间并计算重传超时
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 重传超时默认范围.单位:ms
+const (
+	gRtoMinDefault = 10
+	gRtoMaxDefault = 60000
+)
+
+// RttInfo 往返时间估计
+type RttInfo struct {
+	// 平滑往返时间
+	Srtt time.Duration
+	// 往返时间偏差
+	Rttvar time.Duration
+	// 重传超时
+	Rto time.Duration
+	// 采样次数
+	Samples int
+}
+
+// tPeerKey 对端关键字
+type tPeerKey struct {
+	pipe uint64
+	ia   uint64
+}
+
+// tRttItem 往返时间估计.单位:us
+type tRttItem struct {
+	srtt    int64
+	rttvar  int64
+	samples int
+}
+
+// RttEstimate 读取默认端点对某个对端的往返时间估计
+// 没有采样时返回false
+func RttEstimate(pipe uint64, ia uint64) (RttInfo, bool) {
+	return defaultEndpoint.RttEstimate(pipe, ia)
+}
+
+// RttEstimate 读取对某个对端的往返时间估计
+// 没有采样时返回false
+func (e *Endpoint) RttEstimate(pipe uint64, ia uint64) (RttInfo, bool) {
+	param := e.getParam()
+
+	e.rttItemsMutex.Lock()
+	defer e.rttItemsMutex.Unlock()
+
+	item, ok := e.rttItems[tPeerKey{pipe: pipe, ia: ia}]
+	if ok == false {
+		return RttInfo{}, false
+	}
+	var info RttInfo
+	info.Srtt = time.Duration(item.srtt) * time.Microsecond
+	info.Rttvar = time.Duration(item.rttvar) * time.Microsecond
+	info.Rto = time.Duration(rttCalcRto(&param, item)) * time.Microsecond
+	info.Samples = item.samples
+	return info, true
+}
+
+// rttSample 加入往返时间采样.单位:us
+// 重传帧的应答不能作为采样
+func (e *Endpoint) rttSample(pipe uint64, ia uint64, rtt int64) {
+	if rtt < 0 {
+		return
+	}
+
+	e.rttItemsMutex.Lock()
+	defer e.rttItemsMutex.Unlock()
+
+	key := tPeerKey{pipe: pipe, ia: ia}
+	item, ok := e.rttItems[key]
+	if ok == false {
+		item = &tRttItem{srtt: rtt, rttvar: rtt / 2, samples: 1}
+		e.rttItems[key] = item
+		return
+	}
+
+	delta := item.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	item.rttvar = (3*item.rttvar + delta) / 4
+	item.srtt = (7*item.srtt + rtt) / 8
+	item.samples++
+	logDebug("rtt sample.pipe:0x%x ia:0x%x rtt:%dus srtt:%dus rttvar:%dus", pipe, ia, rtt, item.srtt, item.rttvar)
+}
+
+// retryInterval 计算第retryNum次重传的间隔.单位:us
+// 未开启自适应重传时使用固定间隔BlockRetryInterval
+func (e *Endpoint) retryInterval(pipe uint64, ia uint64, retryNum int) int64 {
+	param := e.getParam()
+	if param.IsAdaptiveRetry == false {
+		return int64(param.BlockRetryInterval) * 1000
+	}
+
+	rto := int64(param.BlockRetryInterval) * 1000
+	e.rttItemsMutex.Lock()
+	item, ok := e.rttItems[tPeerKey{pipe: pipe, ia: ia}]
+	if ok {
+		rto = rttCalcRto(&param, item)
+	}
+	e.rttItemsMutex.Unlock()
+
+	// 指数退避
+	rtoMax := rttRtoMax(&param)
+	for i := 0; i < retryNum && rto < rtoMax; i++ {
+		rto *= 2
+	}
+	if rto > rtoMax {
+		rto = rtoMax
+	}
+	// 随机抖动.范围是[1, 1.5)倍,避免多个调用同时重传
+	return rto + rand.Int63n(rto/2+1)
+}
+
+// rttCalcRto 计算重传超时.单位:us
+func rttCalcRto(param *LoadParam, item *tRttItem) int64 {
+	rto := item.srtt + 4*item.rttvar
+	rtoMin := int64(param.RtoMin) * 1000
+	if rtoMin == 0 {
+		rtoMin = gRtoMinDefault * 1000
+	}
+	if rto < rtoMin {
+		rto = rtoMin
+	}
+	rtoMax := rttRtoMax(param)
+	if rto > rtoMax {
+		rto = rtoMax
+	}
+	return rto
+}
+
+func rttRtoMax(param *LoadParam) int64 {
+	if param.RtoMax == 0 {
+		return gRtoMaxDefault * 1000
+	}
+	return int64(param.RtoMax) * 1000
+}
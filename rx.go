@@ -4,32 +4,27 @@
 
 package dcom
 
-// gRxLoad 模块载入
-func gRxLoad() {
-	gBlockRxSetCallback(dealRecv)
-}
-
-func dealRecv(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
+func (e *Endpoint) dealRecv(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 	logInfo("receive data.token:%d code:%d src ia:0x%x", frame.controlWord.token, frame.controlWord.code, srcIA)
 	if frame.controlWord.code == gCodeCon || frame.controlWord.code == gCodeNon {
-		gRxCon(protocol, pipe, srcIA, frame)
+		e.rxCon(protocol, pipe, srcIA, frame)
 		return
 	}
 	if frame.controlWord.code == gCodeAck {
-		gRxAckFrame(protocol, pipe, srcIA, frame)
+		e.rxAckFrame(protocol, pipe, srcIA, frame)
 		return
 	}
 	if frame.controlWord.code == gCodeBack {
-		gBlockRxBackFrame(protocol, pipe, srcIA, frame)
+		e.blockRxBackFrame(protocol, pipe, srcIA, frame)
 		return
 	}
 	if frame.controlWord.code == gCodeRst {
 		if len(frame.payload) != 1 || frame.controlWord.payloadLen != 1 {
 			return
 		}
-		gRxRstFrame(protocol, pipe, srcIA, frame)
-		gBlockRxDealRstFrame(protocol, pipe, srcIA, frame)
-		gBlockTxDealRstFrame(protocol, pipe, srcIA, frame)
+		e.rxRstFrame(protocol, pipe, srcIA, frame)
+		e.blockRxDealRstFrame(protocol, pipe, srcIA, frame)
+		e.blockTxDealRstFrame(protocol, pipe, srcIA, frame)
 		return
 	}
 }
@@ -38,6 +33,18 @@ func dealRecv(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 // 应用模块接收到数据后需调用本函数
 // 本函数接收帧的格式为DCOM协议数据
 func Receive(protocol int, pipe uint64, srcIA uint64, bytes []uint8) {
+	defaultEndpoint.Receive(protocol, pipe, srcIA, bytes)
+}
+
+// Receive 接收数据
+// 应用模块接收到数据后需调用本函数
+// 本函数接收帧的格式为DCOM协议数据
+func (e *Endpoint) Receive(protocol int, pipe uint64, srcIA uint64, bytes []uint8) {
+	if e.isStopped() {
+		logWarn("receive data failed!endpoint is stopped.src ia:0x%x", srcIA)
+		return
+	}
+
 	frame := gBytesToFrame(bytes)
 	if frame == nil {
 		logWarn("receive data error:bytes to frame failed.src ia:0x%x", srcIA)
@@ -45,13 +52,13 @@ func Receive(protocol int, pipe uint64, srcIA uint64, bytes []uint8) {
 	}
 
 	if frame.controlWord.blockFlag == 0 {
-		dealRecv(protocol, pipe, srcIA, frame)
+		e.dealRecv(protocol, pipe, srcIA, frame)
 	} else {
 		blockFrame := gByetsToBlockFrame(bytes)
 		if blockFrame == nil {
 			logWarn("receive data error:bytes to block frame failed.src ia:0x%x", srcIA)
 			return
 		}
-		gBlockRxReceive(protocol, pipe, srcIA, blockFrame)
+		e.blockRxReceive(protocol, pipe, srcIA, blockFrame)
 	}
 }
@@ -4,35 +4,65 @@
 
 package dcom
 
-// gRxCon 接收到连接帧时处理函数
-func gRxCon(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
+// rxCon 接收到连接帧时处理函数
+func (e *Endpoint) rxCon(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 	logInfo("rx con.token:%d", frame.controlWord.token)
-	resp, err := gCallback(protocol, pipe, srcIA, frame.controlWord.rid, frame.payload)
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	if frame.controlWord.code == gCodeCon {
+		if e.isDeferPending(key) {
+			logInfo("rx con is waiting defer response.ignore.token:%d", frame.controlWord.token)
+			return
+		}
+		if e.dedupCheck(key) {
+			return
+		}
+	}
+
+	w := e.callback(protocol, pipe, srcIA, frame)
 
 	// NON不需要应答
 	if frame.controlWord.code == gCodeNon {
 		return
 	}
+	// 延迟应答由服务通过Responder完成
+	if w.responder != nil {
+		return
+	}
+	e.respond(protocol, pipe, srcIA, frame.controlWord.rid, frame.controlWord.token, w.data, w.code)
+}
 
+// respond 应答请求并缓存应答.返回管道的发送错误
+func (e *Endpoint) respond(protocol int, pipe uint64, dstIA uint64, rid int, token int, resp []uint8,
+	err int) error {
+	e.dedupSave(tExchangeKey{protocol: protocol, pipe: pipe, ia: dstIA, rid: rid, token: token}, resp, err)
+	return e.sendResponse(protocol, pipe, dstIA, rid, token, resp, err)
+}
+
+// sendResponse 发送应答.错误码非SystemOK时发送复位连接帧.返回管道的发送错误
+func (e *Endpoint) sendResponse(protocol int, pipe uint64, dstIA uint64, rid int, token int, resp []uint8,
+	err int) error {
 	if err != SystemOK {
-		logInfo("service send err:0x%x token:%d", err, frame.controlWord.token)
-		gSendRstFrame(protocol, pipe, srcIA, err, frame.controlWord.rid, frame.controlWord.token)
-		return
+		logInfo("service send err:0x%x token:%d", err, token)
+		return e.sendRstFrame(protocol, pipe, dstIA, err, rid, token)
 	}
 
-	if len(resp) > gSingleFrameSizeMax {
+	if len(resp) > e.frameSizeMax(pipe) {
+		if e.blockTxIsSizeValid(pipe, len(resp)) == false {
+			logWarn("service send failed!resp len is invalid:%d.token:%d", len(resp), token)
+			return e.sendRstFrame(protocol, pipe, dstIA, SystemErrorParamInvalid, rid, token)
+		}
 		// 长度过长启动块传输
-		logInfo("service send too long:%d.start block tx.token:%d", len(resp), frame.controlWord.token)
-		gBlockTx(protocol, pipe, srcIA, gCodeAck, frame.controlWord.rid, frame.controlWord.token, resp)
-		return
+		logInfo("service send too long:%d.start block tx.token:%d", len(resp), token)
+		return e.blockTx(protocol, pipe, dstIA, gCodeAck, rid, token, resp, nil)
 	}
 
 	var ackFrame tFrame
 	ackFrame.controlWord.code = gCodeAck
 	ackFrame.controlWord.blockFlag = 0
-	ackFrame.controlWord.rid = frame.controlWord.rid
-	ackFrame.controlWord.token = frame.controlWord.token
+	ackFrame.controlWord.rid = rid
+	ackFrame.controlWord.token = token
 	ackFrame.controlWord.payloadLen = len(resp)
 	ackFrame.payload = append(ackFrame.payload, resp...)
-	gSend(protocol, pipe, srcIA, &ackFrame)
+	return e.send(protocol, pipe, dstIA, &ackFrame)
 }
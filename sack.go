@@ -0,0 +1,102 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 块传输选择确认模块.BACK帧在确认偏移地址后附加接收方已缓存的乱序数据范围
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// BACK帧确认偏移地址的字节数.选择确认范围的起始和结束偏移地址字节数相同
+	gBackOffsetLen = 2
+	// 扩展块传输BACK帧确认偏移地址的字节数
+	gBackOffsetExtLen = 4
+	// BACK帧最多携带的选择确认范围数
+	gSackRangeMax = 4
+	// 块传输接收乱序缓存的默认帧数
+	gBlockReorderFramesDefault = 32
+)
+
+// tSackRange 选择确认范围.接收方已缓存[start, end)的数据
+type tSackRange struct {
+	start int
+	end   int
+}
+
+// sackRanges 根据乱序缓存计算选择确认范围.相邻的帧合并为一个范围,按偏移地址从小到大最多取gSackRangeMax个
+func sackRanges(pending map[int][]uint8) []tSackRange {
+	if len(pending) == 0 {
+		return nil
+	}
+	offsets := make([]int, 0, len(pending))
+	for offset := range pending {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	var ranges []tSackRange
+	for _, offset := range offsets {
+		end := offset + len(pending[offset])
+		if len(ranges) > 0 && ranges[len(ranges)-1].end >= offset {
+			if ranges[len(ranges)-1].end < end {
+				ranges[len(ranges)-1].end = end
+			}
+			continue
+		}
+		if len(ranges) == gSackRangeMax {
+			break
+		}
+		ranges = append(ranges, tSackRange{start: offset, end: end})
+	}
+	return ranges
+}
+
+// gBackToBytes BACK帧载荷.确认偏移地址后附加选择确认范围.大端顺序
+// 扩展块传输的偏移地址和范围都是32位
+func gBackToBytes(offset int, ranges []tSackRange, isExt bool) []uint8 {
+	var bytes []uint8
+	bytes = appendBackOffset(bytes, offset, isExt)
+	for _, r := range ranges {
+		bytes = appendBackOffset(bytes, r.start, isExt)
+		bytes = appendBackOffset(bytes, r.end, isExt)
+	}
+	return bytes
+}
+
+// gBytesToBack 解析BACK帧载荷.返回确认偏移地址和选择确认范围,长度错误时返回false
+func gBytesToBack(bytes []uint8, isExt bool) (int, []tSackRange, bool) {
+	offsetLen := gBackOffsetLen
+	if isExt {
+		offsetLen = gBackOffsetExtLen
+	}
+	if len(bytes) < offsetLen || (len(bytes)-offsetLen)%(2*offsetLen) != 0 {
+		return 0, nil, false
+	}
+	offset := parseBackOffset(bytes, isExt)
+	var ranges []tSackRange
+	for i := offsetLen; i < len(bytes); i += 2 * offsetLen {
+		r := tSackRange{start: parseBackOffset(bytes[i:], isExt), end: parseBackOffset(bytes[i+offsetLen:], isExt)}
+		if r.start >= r.end {
+			return 0, nil, false
+		}
+		ranges = append(ranges, r)
+	}
+	return offset, ranges, true
+}
+
+func appendBackOffset(bytes []uint8, offset int, isExt bool) []uint8 {
+	if isExt {
+		return append(bytes, uint8(offset>>24), uint8(offset>>16), uint8(offset>>8), uint8(offset))
+	}
+	return append(bytes, uint8(offset>>8), uint8(offset))
+}
+
+func parseBackOffset(bytes []uint8, isExt bool) int {
+	if isExt {
+		return int(binary.BigEndian.Uint32(bytes))
+	}
+	return (int(bytes[0]) << 8) + int(bytes[1])
+}
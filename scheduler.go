@@ -0,0 +1,191 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 定时调度模块.所有重传和超时由一个定时器堆驱动,空闲时休眠到最近的截止时间
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tTimer 定时器
+type tTimer struct {
+	// 截止时间.单位:us
+	at int64
+	// 优先级.同一批到期的定时器中优先级高的先执行
+	priority int
+	fn       func()
+	// 在堆中的序号.-1表示未调度
+	index int
+}
+
+// tTimerHeap 定时器堆.按截止时间和优先级排序
+type tTimerHeap []*tTimer
+
+func (h tTimerHeap) Len() int {
+	return len(h)
+}
+
+func (h tTimerHeap) Less(i, j int) bool {
+	if h[i].at == h[j].at {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].at < h[j].at
+}
+
+func (h tTimerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *tTimerHeap) Push(x interface{}) {
+	timer := x.(*tTimer)
+	timer.index = len(*h)
+	*h = append(*h, timer)
+}
+
+func (h *tTimerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	timer := old[n-1]
+	old[n-1] = nil
+	timer.index = -1
+	*h = old[:n-1]
+	return timer
+}
+
+// 调度线程单次休眠的上限.单位:us
+const gSchedulerWaitMax = int64(time.Hour / time.Microsecond)
+
+// tScheduler 调度器
+type tScheduler struct {
+	timers tTimerHeap
+	mutex  sync.Mutex
+	// 唤醒信号.最近的截止时间提前时唤醒调度线程
+	wake chan struct{}
+}
+
+func newTimer(priority int, fn func()) *tTimer {
+	return &tTimer{priority: priority, fn: fn, index: -1}
+}
+
+// schedule 设置定时器在at时刻执行.单位:us.已调度的定时器会重新调度
+func (s *tScheduler) schedule(timer *tTimer, at int64) {
+	s.mutex.Lock()
+	timer.at = at
+	if timer.index >= 0 {
+		heap.Fix(&s.timers, timer.index)
+	} else {
+		heap.Push(&s.timers, timer)
+	}
+	isFirst := s.timers[0] == timer
+	s.mutex.Unlock()
+
+	if isFirst {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancel 取消定时器
+func (s *tScheduler) cancel(timer *tTimer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if timer.index >= 0 {
+		heap.Remove(&s.timers, timer.index)
+	}
+}
+
+// popExpired 取出所有到期的定时器
+// 到期定时器按优先级从高到低排列,同优先级按截止时间.返回值是到期定时器和下一个截止时间.没有定时器时截止时间为-1
+func (s *tScheduler) popExpired(now int64) ([]*tTimer, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []*tTimer
+	for len(s.timers) > 0 && s.timers[0].at <= now {
+		expired = append(expired, heap.Pop(&s.timers).(*tTimer))
+	}
+	// 调度线程晚于截止时间醒来时,高优先级的重传先发送
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].priority > expired[j].priority
+	})
+	if len(s.timers) == 0 {
+		return expired, -1
+	}
+	return expired, s.timers[0].at
+}
+
+// clear 清空所有定时器
+func (s *tScheduler) clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, timer := range s.timers {
+		timer.index = -1
+	}
+	s.timers = nil
+}
+
+// threadSchedulerRun 调度线程
+// 执行到期的定时器,然后休眠到下一个截止时间或者被唤醒
+func (e *Endpoint) threadSchedulerRun(quit chan struct{}) {
+	defer e.threads.Done()
+
+	timer := e.getClock().NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		expired, next := e.scheduler.popExpired(e.getTime())
+		for _, t := range expired {
+			t.fn()
+		}
+		if len(expired) > 0 {
+			// 执行定时器期间可能加入了新的定时器
+			continue
+		}
+
+		var wait <-chan time.Time
+		if next >= 0 {
+			if timer.Stop() == false {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+			timer.Reset(schedulerWaitDuration(next - e.getTime()))
+			// 读取时间到设置定时器之间时钟可能已经越过截止时间
+			if e.getTime() >= next {
+				continue
+			}
+			wait = timer.C()
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-e.scheduler.wake:
+		case <-wait:
+		}
+	}
+}
+
+// schedulerWaitDuration 休眠时长.超过上限时休眠上限时长后重新检查,防止转换时溢出
+func schedulerWaitDuration(delta int64) time.Duration {
+	if delta > gSchedulerWaitMax {
+		delta = gSchedulerWaitMax
+	}
+	return time.Duration(delta) * time.Microsecond
+}
+
+// deadlineAdd 计算截止时间.单位:us.防止溢出
+func deadlineAdd(start int64, delta int64) int64 {
+	if delta > gTimeMax-start {
+		return gTimeMax
+	}
+	return start + delta
+}
@@ -0,0 +1,25 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 分片模块.等待队列和块传输队列按会话关键字分片,每个分片独立加锁
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+// 分片数
+const gShardNum = 16
+
+// tBlockKey 块传输关键字.同一会话的请求和应答块传输通过code区分
+type tBlockKey struct {
+	tExchangeKey
+	code int
+}
+
+// shardIndex 计算会话所在分片
+// 协议号和code不参与计算,保证同一会话的不同code位于同一分片
+func shardIndex(key *tExchangeKey) int {
+	h := key.pipe*0x9e3779b97f4a7c15 ^ key.ia*0xc2b2ae3d27d4eb4f ^ uint64(key.rid)<<10 ^ uint64(key.token)
+	h ^= h >> 31
+	return int(h % gShardNum)
+}
+
+// blockCodes 块传输可能的code.接收BACK和RST帧时依次查找
+var blockCodes = []int{gCodeCon, gCodeNon, gCodeAck}
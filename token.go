@@ -0,0 +1,102 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// token分配模块.每个对端独立分配token,跳过仍在使用的token
+// Authors: jdh99 <jdh821@163.com>
+
+package dcom
+
+import "sync"
+
+// tTokenPeer 对端的token分配状态
+type tTokenPeer struct {
+	// 下一个候选token
+	next int
+	// 使用中的token及其引用数.等待队列和块传输发送队列各持有一个引用
+	inUse map[int]int
+}
+
+// tTokenAllocator token分配表
+// 对端的token全部释放后删除分配状态,新建的对端从上次删除时的候选token继续分配,
+// 避免刚释放的token立即被重用而与对端缓存的会话冲突
+type tTokenAllocator struct {
+	items map[tPeerKey]*tTokenPeer
+	// 新建对端的候选token
+	next  int
+	mutex sync.Mutex
+}
+
+// allocToken 为对端分配一个未使用的token,分配的token引用数为1
+// 对端所有token都在使用中时返回false
+func (e *Endpoint) allocToken(pipe uint64, dstIA uint64) (int, bool) {
+	e.tokens.mutex.Lock()
+	defer e.tokens.mutex.Unlock()
+
+	key := tPeerKey{pipe: pipe, ia: dstIA}
+	peer, ok := e.tokens.items[key]
+	if ok == false {
+		peer = &tTokenPeer{next: e.tokens.next, inUse: make(map[int]int)}
+		e.tokens.items[key] = peer
+	}
+	if len(peer.inUse) > gTokenMax {
+		return 0, false
+	}
+	for {
+		token := peer.next
+		peer.next = (peer.next + 1) & gTokenMax
+		if _, ok := peer.inUse[token]; ok == false {
+			peer.inUse[token] = 1
+			return token, true
+		}
+	}
+}
+
+// holdToken 增加token引用
+func (e *Endpoint) holdToken(pipe uint64, dstIA uint64, token int) {
+	e.tokens.mutex.Lock()
+	defer e.tokens.mutex.Unlock()
+
+	peer, ok := e.tokens.items[tPeerKey{pipe: pipe, ia: dstIA}]
+	if ok == false {
+		return
+	}
+	peer.inUse[token]++
+}
+
+// releaseToken 释放token引用.引用数为0时token可以再次分配,同时归还在途名额
+func (e *Endpoint) releaseToken(pipe uint64, dstIA uint64, token int) {
+	e.tokens.mutex.Lock()
+	peer, ok := e.tokens.items[tPeerKey{pipe: pipe, ia: dstIA}]
+	if ok == false {
+		e.tokens.mutex.Unlock()
+		return
+	}
+	num, ok := peer.inUse[token]
+	if ok == false {
+		e.tokens.mutex.Unlock()
+		return
+	}
+	if num > 1 {
+		peer.inUse[token] = num - 1
+		e.tokens.mutex.Unlock()
+		return
+	}
+	delete(peer.inUse, token)
+	if len(peer.inUse) == 0 {
+		e.tokens.next = peer.next
+		delete(e.tokens.items, tPeerKey{pipe: pipe, ia: dstIA})
+	}
+	e.tokens.mutex.Unlock()
+
+	e.inflightRelease(pipe, dstIA)
+}
+
+// tokensInUse 对端使用中的token数
+func (e *Endpoint) tokensInUse(pipe uint64, dstIA uint64) int {
+	e.tokens.mutex.Lock()
+	defer e.tokens.mutex.Unlock()
+
+	peer, ok := e.tokens.items[tPeerKey{pipe: pipe, ia: dstIA}]
+	if ok == false {
+		return 0
+	}
+	return len(peer.inUse)
+}
@@ -0,0 +1,38 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 传输公共模块.数据报和字节流传输共用的信封格式
+// 信封格式:源地址(8字节,大端)+协议号(1字节)+DCOM帧
+// Authors: jdh99 <jdh821@163.com>
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// EnvelopeHeaderLen 信封头部长度
+const EnvelopeHeaderLen = 9
+
+// ErrShortEnvelope 信封长度不足
+var ErrShortEnvelope = errors.New("transport: short envelope")
+
+// Encode 将DCOM帧封装为信封
+func Encode(srcIA uint64, protocol int, frame []uint8) []uint8 {
+	data := make([]uint8, EnvelopeHeaderLen+len(frame))
+	binary.BigEndian.PutUint64(data, srcIA)
+	data[8] = uint8(protocol)
+	copy(data[EnvelopeHeaderLen:], frame)
+	return data
+}
+
+// Decode 解析信封
+// 返回的DCOM帧引用data的内存
+func Decode(data []uint8) (srcIA uint64, protocol int, frame []uint8, err error) {
+	if len(data) <= EnvelopeHeaderLen {
+		return 0, 0, nil, ErrShortEnvelope
+	}
+	srcIA = binary.BigEndian.Uint64(data)
+	protocol = int(data[8])
+	frame = data[EnvelopeHeaderLen:]
+	return srcIA, protocol, frame, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// COBS分帧.帧以0x00结尾
+// Authors: jdh99 <jdh821@163.com>
+
+package serial
+
+// cobsEncode COBS编码.帧前后都加0x00,接收方可以丢弃之前的残余数据
+func cobsEncode(data []uint8) []uint8 {
+	frame := make([]uint8, 1, len(data)+len(data)/254+3)
+	codeIndex := len(frame)
+	frame = append(frame, 0)
+	code := uint8(1)
+	for _, b := range data {
+		if b != 0 {
+			frame = append(frame, b)
+			code++
+		}
+		if b == 0 || code == 0xff {
+			frame[codeIndex] = code
+			codeIndex = len(frame)
+			frame = append(frame, 0)
+			code = 1
+		}
+	}
+	frame[codeIndex] = code
+	return append(frame, 0)
+}
+
+// cobsDecode COBS解码.输入不包括结尾的0x00.格式错误返回false
+func cobsDecode(data []uint8) ([]uint8, bool) {
+	frame := make([]uint8, 0, len(data))
+	for i := 0; i < len(data); {
+		code := int(data[i])
+		if code == 0 || i+code > len(data) {
+			return nil, false
+		}
+		frame = append(frame, data[i+1:i+code]...)
+		i += code
+		if code != 0xff && i < len(data) {
+			frame = append(frame, 0)
+		}
+	}
+	return frame, true
+}
+
+// tCobsDecoder COBS解码器
+type tCobsDecoder struct {
+	buf     []uint8
+	sizeMax int
+	// 当前帧超长.丢弃到下一个0x00
+	isBad bool
+}
+
+// feed 输入一个字节.解码出完整的帧时返回true
+func (d *tCobsDecoder) feed(b uint8) ([]uint8, bool) {
+	if b == 0 {
+		data := d.buf
+		isBad := d.isBad
+		d.buf = nil
+		d.isBad = false
+		if isBad || len(data) == 0 {
+			return nil, false
+		}
+		frame, ok := cobsDecode(data)
+		return frame, ok && len(frame) > 0
+	}
+	if d.isBad {
+		return nil, false
+	}
+	if len(d.buf) > d.sizeMax+d.sizeMax/254+1 {
+		d.isBad = true
+		return nil, false
+	}
+	d.buf = append(d.buf, b)
+	return nil, false
+}
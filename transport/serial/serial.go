@@ -0,0 +1,186 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 串口传输模块.在字节流上使用SLIP或者COBS分帧,可选CRC校验
+// 帧格式:分帧编码(信封+CRC16).CRC16为大端,校验范围是信封
+// Authors: jdh99 <jdh821@163.com>
+
+package serial
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jdhxyy/crc16"
+	"github.com/jdhxyy/dcom"
+	"github.com/jdhxyy/dcom/transport"
+)
+
+// 分帧方式
+const (
+	FramingSLIP = iota
+	FramingCOBS
+)
+
+// 默认参数
+const (
+	// 默认MTU.与DCOM单帧最大长度相同
+	gMtuDefault = 259
+	// 读缓存
+	gReadBufSize = 256
+	gCrcLen      = 2
+)
+
+// Param 传输参数
+type Param struct {
+	// 本机地址.发送的信封中携带此地址
+	LocalIA uint64
+	// 管道号
+	Pipe uint64
+	// 管道MTU.为0时使用默认值259
+	MTU int
+	// 分帧方式
+	Framing int
+	// 是否加CRC16校验
+	IsCrc bool
+}
+
+// tDecoder 分帧解码器
+type tDecoder interface {
+	feed(b uint8) ([]uint8, bool)
+}
+
+// Transport 串口传输.本身是一个管道
+type Transport struct {
+	e       *dcom.Endpoint
+	rwc     io.ReadWriteCloser
+	param   Param
+	receive dcom.ReceiveFunc
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+	closeErr   error
+	// 是否已调用Close.为1时读出错是关闭引起的
+	isClosed int32
+	wg       sync.WaitGroup
+}
+
+// New 在字节流上创建传输并作为管道添加到端点
+// rwc可以是串口,pty或者其他任意字节流
+func New(e *dcom.Endpoint, rwc io.ReadWriteCloser, param *Param) (*Transport, error) {
+	t := &Transport{e: e, rwc: rwc, param: *param}
+	if t.param.MTU == 0 {
+		t.param.MTU = gMtuDefault
+	}
+	receive, err := e.AddPipe(t)
+	if err != nil {
+		return nil, err
+	}
+	t.receive = receive
+	t.wg.Add(1)
+	go t.readRun()
+	return t, nil
+}
+
+// newDecoder 创建解码器.帧最大长度为信封和CRC的最大长度
+func (t *Transport) newDecoder() tDecoder {
+	sizeMax := transport.EnvelopeHeaderLen + t.param.MTU + gCrcLen
+	if t.param.Framing == FramingCOBS {
+		return &tCobsDecoder{sizeMax: sizeMax}
+	}
+	return &tSlipDecoder{sizeMax: sizeMax}
+}
+
+// readRun 接收线程.读出错时退出
+// 不是关闭引起的读错误(比如设备拔出)时从端点移除管道,管道上等待应答的调用以SystemErrorPipeClosed结束
+func (t *Transport) readRun() {
+	decoder := t.newDecoder()
+	buf := make([]uint8, gReadBufSize)
+	for {
+		n, err := t.rwc.Read(buf)
+		for _, b := range buf[:n] {
+			frame, ok := decoder.feed(b)
+			if ok {
+				t.dealFrame(frame)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// 移除管道时会调用Close等待接收线程退出,所以先结束等待
+	t.wg.Done()
+	if atomic.LoadInt32(&t.isClosed) == 0 {
+		t.e.RemovePipe(t.param.Pipe)
+	}
+}
+
+// dealFrame 处理解码后的帧.校验失败或者格式错误的帧丢弃
+func (t *Transport) dealFrame(data []uint8) {
+	if t.param.IsCrc {
+		if len(data) <= gCrcLen {
+			return
+		}
+		n := len(data) - gCrcLen
+		if crc16.Checksum(data[:n]) != uint16(data[n])<<8|uint16(data[n+1]) {
+			return
+		}
+		data = data[:n]
+	}
+	srcIA, protocol, frame, err := transport.Decode(data)
+	if err != nil {
+		return
+	}
+	t.receive(protocol, srcIA, frame)
+}
+
+// ID 管道号
+func (t *Transport) ID() uint64 {
+	return t.param.Pipe
+}
+
+// MTU 管道MTU
+func (t *Transport) MTU() int {
+	return t.param.MTU
+}
+
+// Send 分帧后写入字节流
+func (t *Transport) Send(protocol int, dstIA uint64, bytes []uint8) error {
+	data := transport.Encode(t.param.LocalIA, protocol, bytes)
+	if t.param.IsCrc {
+		crc := crc16.Checksum(data)
+		data = append(data, uint8(crc>>8), uint8(crc))
+	}
+	var frame []uint8
+	if t.param.Framing == FramingCOBS {
+		frame = cobsEncode(data)
+	} else {
+		frame = slipEncode(data)
+	}
+
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	_, err := t.rwc.Write(frame)
+	return err
+}
+
+// AllowSend 是否允许发送
+func (t *Transport) AllowSend() bool {
+	return true
+}
+
+// Close 关闭字节流并等待接收线程退出.从端点移除管道时调用
+func (t *Transport) Close() error {
+	t.closeOnce.Do(func() {
+		atomic.StoreInt32(&t.isClosed, 1)
+		t.closeErr = t.rwc.Close()
+		t.wg.Wait()
+	})
+	return t.closeErr
+}
+
+// Shutdown 从端点移除管道并关闭传输
+func (t *Transport) Shutdown() error {
+	t.e.RemovePipe(t.param.Pipe)
+	return t.Close()
+}
@@ -0,0 +1,139 @@
+package serial
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jdhxyy/crc16"
+	"github.com/jdhxyy/dcom"
+	"github.com/jdhxyy/dcom/transport"
+)
+
+func TestFraming(t *testing.T) {
+	data := make([]uint8, 600)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	garbage := []uint8{0x12, gSlipEsc, 0x34, 0x00, 0x56}
+
+	var slip tSlipDecoder
+	slip.sizeMax = 1000
+	var cobs tCobsDecoder
+	cobs.sizeMax = 1000
+	cases := []struct {
+		decoder tDecoder
+		encode  func([]uint8) []uint8
+	}{
+		{&slip, slipEncode},
+		{&cobs, cobsEncode},
+	}
+	for _, c := range cases {
+		stream := append(append([]uint8{}, garbage...), c.encode(data)...)
+		stream = append(stream, c.encode([]uint8{0xc0, 0xdb, 0x00})...)
+		var frames [][]uint8
+		for _, b := range stream {
+			if frame, ok := c.decoder.feed(b); ok {
+				frames = append(frames, frame)
+			}
+		}
+		if len(frames) < 2 || bytes.Equal(frames[len(frames)-2], data) == false ||
+			bytes.Equal(frames[len(frames)-1], []uint8{0xc0, 0xdb, 0x00}) == false {
+			t.Fatal("decode failed", len(frames))
+		}
+	}
+}
+
+func TestSerial(t *testing.T) {
+	for _, framing := range []int{FramingSLIP, FramingCOBS} {
+		var param dcom.LoadParam
+		param.BlockRetryMaxNum = 5
+		param.BlockRetryInterval = 100
+		a := dcom.NewEndpoint(&param)
+		b := dcom.NewEndpoint(&param)
+
+		connA, connB := net.Pipe()
+		ta, err := New(a, connA, &Param{LocalIA: 0x1, Pipe: 1, Framing: framing, IsCrc: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tb, err := New(b, connB, &Param{LocalIA: 0x2, Pipe: 1, Framing: framing, IsCrc: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+			return req, dcom.SystemOK
+		})
+		req := make([]uint8, 1000)
+		for i := range req {
+			req[i] = uint8(i)
+		}
+		resp, code := a.Call(0, 1, 0x2, 1, 3000, req)
+		if code != dcom.SystemOK || bytes.Equal(resp, req) == false {
+			t.Fatal("call over serial failed", framing, code, len(resp))
+		}
+
+		ta.Shutdown()
+		tb.Shutdown()
+		a.Close(context.Background())
+		b.Close(context.Background())
+	}
+}
+
+func TestSerialReadError(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := dcom.NewEndpoint(&param)
+	defer a.Close(context.Background())
+
+	connA, connB := net.Pipe()
+	go io.Copy(ioutil.Discard, connB)
+	_, err := New(a, connA, &Param{LocalIA: 0x1, Pipe: 1, IsCrc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := a.CallAsync(0, 1, 0x2, 1, 3000, []uint8{1})
+	// 对端断开后读出错,等待应答的调用结束
+	connB.Close()
+	select {
+	case r := <-resp.Done:
+		if r.Error != dcom.SystemErrorPipeClosed {
+			t.Fatal("call should fail with pipe closed", r.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call should end after read error")
+	}
+	if _, err := a.AddPipe(&Transport{param: Param{Pipe: 1}}); err != nil {
+		t.Fatal("pipe should be removed", err)
+	}
+}
+
+func TestSerialCrc(t *testing.T) {
+	var frames [][]uint8
+	tr := &Transport{param: Param{IsCrc: true}}
+	tr.receive = func(protocol int, srcIA uint64, bytes []uint8) {
+		frames = append(frames, bytes)
+	}
+
+	data := transport.Encode(0x1, 0, []uint8{0x40, 0x04, 0x00, 0x01, 0x55})
+	crc := crc16.Checksum(data)
+	data = append(data, uint8(crc>>8), uint8(crc))
+	tr.dealFrame(data)
+	if len(frames) != 1 {
+		t.Fatal("valid frame should be received")
+	}
+
+	// 校验错误的帧丢弃
+	data[len(data)-3] ^= 0xff
+	tr.dealFrame(data)
+	if len(frames) != 1 {
+		t.Fatal("bad crc frame should be dropped")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// SLIP分帧.RFC 1055
+// Authors: jdh99 <jdh821@163.com>
+
+package serial
+
+// SLIP特殊字符
+const (
+	gSlipEnd    = 0xc0
+	gSlipEsc    = 0xdb
+	gSlipEscEnd = 0xdc
+	gSlipEscEsc = 0xdd
+)
+
+// slipEncode SLIP编码.帧前后都加END,接收方可以丢弃之前的残余数据
+func slipEncode(data []uint8) []uint8 {
+	frame := make([]uint8, 0, len(data)+len(data)/8+2)
+	frame = append(frame, gSlipEnd)
+	for _, b := range data {
+		switch b {
+		case gSlipEnd:
+			frame = append(frame, gSlipEsc, gSlipEscEnd)
+		case gSlipEsc:
+			frame = append(frame, gSlipEsc, gSlipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, gSlipEnd)
+}
+
+// tSlipDecoder SLIP解码器
+type tSlipDecoder struct {
+	buf     []uint8
+	sizeMax int
+	isEsc   bool
+	// 当前帧出错.丢弃到下一个END
+	isBad bool
+}
+
+// feed 输入一个字节.解码出完整的帧时返回true
+func (d *tSlipDecoder) feed(b uint8) ([]uint8, bool) {
+	if b == gSlipEnd {
+		frame := d.buf
+		isOK := d.isBad == false && d.isEsc == false && len(frame) > 0
+		d.buf = nil
+		d.isEsc = false
+		d.isBad = false
+		return frame, isOK
+	}
+	if d.isBad {
+		return nil, false
+	}
+
+	if d.isEsc {
+		d.isEsc = false
+		switch b {
+		case gSlipEscEnd:
+			b = gSlipEnd
+		case gSlipEscEsc:
+			b = gSlipEsc
+		default:
+			d.isBad = true
+			return nil, false
+		}
+	} else if b == gSlipEsc {
+		d.isEsc = true
+		return nil, false
+	}
+
+	if len(d.buf) >= d.sizeMax {
+		d.isBad = true
+		return nil, false
+	}
+	d.buf = append(d.buf, b)
+	return nil, false
+}
@@ -0,0 +1,139 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 字节流传输客户端.连接断开后按指数退避重连
+// Authors: jdh99 <jdh821@163.com>
+
+package stream
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+// 重连间隔默认值
+const (
+	gReconnectIntervalMin = 100 * time.Millisecond
+	gReconnectIntervalMax = 10 * time.Second
+)
+
+// ClientParam 客户端参数
+type ClientParam struct {
+	Param
+	// 管道号.重连后不变
+	Pipe uint64
+	// 重连间隔下限和上限.为0时使用默认值100ms和10s
+	ReconnectIntervalMin time.Duration
+	ReconnectIntervalMax time.Duration
+}
+
+// Client 客户端
+type Client struct {
+	e       *dcom.Endpoint
+	network string
+	address string
+	param   ClientParam
+
+	conn     *tConn
+	mutex    sync.Mutex
+	isClosed bool
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Dial 连接服务端并接入端点
+// 首次连接失败返回错误.连接建立后断开时自动重连,断开期间管道不存在,调用立即失败
+func Dial(e *dcom.Endpoint, network string, address string, param *ClientParam) (*Client, error) {
+	c := &Client{e: e, network: network, address: address, param: *param, quit: make(chan struct{})}
+	if c.param.ReconnectIntervalMin == 0 {
+		c.param.ReconnectIntervalMin = gReconnectIntervalMin
+	}
+	if c.param.ReconnectIntervalMax == 0 {
+		c.param.ReconnectIntervalMax = gReconnectIntervalMax
+	}
+	if c.param.WriteTimeout == 0 {
+		c.param.WriteTimeout = gWriteTimeout
+	}
+
+	conn, receive, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.wg.Add(1)
+	go c.run(conn, receive)
+	return c, nil
+}
+
+// dial 连接服务端并添加管道
+func (c *Client) dial() (*tConn, dcom.ReceiveFunc, error) {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &tConn{conn: conn, id: c.param.Pipe, param: &c.param.Param}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.isClosed {
+		conn.Close()
+		return nil, nil, ErrClosed
+	}
+	receive, err := attach(c.e, tc)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.conn = tc
+	return tc, receive, nil
+}
+
+// run 服务连接,断开后重连
+func (c *Client) run(conn *tConn, receive dcom.ReceiveFunc) {
+	defer c.wg.Done()
+
+	for {
+		serve(c.e, conn, receive)
+
+		interval := c.param.ReconnectIntervalMin
+		for {
+			select {
+			case <-c.quit:
+				return
+			case <-time.After(interval):
+			}
+			interval *= 2
+			if interval > c.param.ReconnectIntervalMax {
+				interval = c.param.ReconnectIntervalMax
+			}
+
+			var err error
+			conn, receive, err = c.dial()
+			if err == ErrClosed {
+				return
+			}
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// Close 断开连接并停止重连
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.isClosed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	conn := c.conn
+	c.mutex.Unlock()
+
+	close(c.quit)
+	var err error
+	if conn != nil {
+		err = conn.conn.Close()
+	}
+	c.wg.Wait()
+	return err
+}
@@ -0,0 +1,109 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 字节流传输服务端.每个接入的连接分配一个管道
+// Authors: jdh99 <jdh821@163.com>
+
+package stream
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jdhxyy/dcom"
+)
+
+// Server 服务端
+type Server struct {
+	e     *dcom.Endpoint
+	ln    net.Listener
+	param Param
+
+	conns    map[uint64]*tConn
+	mutex    sync.Mutex
+	isClosed bool
+	wg       sync.WaitGroup
+}
+
+// Listen 监听地址并接入端点
+// network可以是"tcp","tcp6"或者"unix"等net.Listen支持的网络
+func Listen(e *dcom.Endpoint, network string, address string, param *Param) (*Server, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{e: e, ln: ln, param: *param, conns: make(map[uint64]*tConn)}
+	if s.param.WriteTimeout == 0 {
+		s.param.WriteTimeout = gWriteTimeout
+	}
+	s.wg.Add(1)
+	go s.acceptRun()
+	return s, nil
+}
+
+// Addr 监听地址
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// acceptRun 接入线程
+func (s *Server) acceptRun() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &tConn{conn: conn, param: &s.param}
+		// 每个连接由端点分配独立的管道号,与其他服务端和地址表的管道号不会冲突
+		// Unix套接字接入的连接远端地址都相同,不能按地址分配
+		c.id = s.e.AllocPipeID()
+		s.mutex.Lock()
+		if s.isClosed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[c.id] = c
+		s.mutex.Unlock()
+
+		receive, err := attach(s.e, c)
+		if err != nil {
+			s.mutex.Lock()
+			delete(s.conns, c.id)
+			s.mutex.Unlock()
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			serve(s.e, c, receive)
+
+			s.mutex.Lock()
+			delete(s.conns, c.id)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Close 停止监听并断开所有连接
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.isClosed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.isClosed = true
+	var conns []*tConn
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mutex.Unlock()
+
+	err := s.ln.Close()
+	for _, c := range conns {
+		c.conn.Close()
+	}
+	s.wg.Wait()
+	return err
+}
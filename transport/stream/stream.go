@@ -0,0 +1,158 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// 字节流传输模块.在TCP或者Unix套接字上传输DCOM帧,每个连接映射为一个管道
+// 帧格式:长度(2字节,大端)+信封
+// Authors: jdh99 <jdh821@163.com>
+
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+	"github.com/jdhxyy/dcom/transport"
+)
+
+const (
+	// 长度字段字节数
+	gLengthLen = 2
+	// 写超时默认值
+	gWriteTimeout = time.Second
+)
+
+// ErrClosed 传输已关闭
+var ErrClosed = errors.New("stream: transport closed")
+
+// errFrameTooLong 帧超过长度字段范围
+var errFrameTooLong = errors.New("stream: frame too long")
+
+// errPartialWrite 写超时时只写入了部分帧.连接已关闭
+var errPartialWrite = errors.New("stream: write timeout after partial frame")
+
+// tWriteTimeoutError 写超时错误.没有写入任何字节,是临时错误,调用计为一次重传
+type tWriteTimeoutError struct{}
+
+func (tWriteTimeoutError) Error() string {
+	return "stream: write timeout"
+}
+
+func (tWriteTimeoutError) Timeout() bool {
+	return true
+}
+
+func (tWriteTimeoutError) Temporary() bool {
+	return true
+}
+
+// Param 传输参数
+type Param struct {
+	// 本机地址.发送的信封中携带此地址
+	LocalIA uint64
+	// 管道MTU.为0时使用DCOM默认值
+	MTU int
+	// 写超时.为0时使用默认值1s.对端不读取时发送不会一直阻塞端点的调度线程
+	WriteTimeout time.Duration
+	// 连接建立和断开时的回调.可以为nil
+	OnConnect    func(pipe uint64, addr net.Addr)
+	OnDisconnect func(pipe uint64, addr net.Addr)
+}
+
+// tConn 连接管道
+type tConn struct {
+	conn       net.Conn
+	id         uint64
+	param      *Param
+	writeMutex sync.Mutex
+}
+
+func (c *tConn) ID() uint64 {
+	return c.id
+}
+
+func (c *tConn) MTU() int {
+	return c.param.MTU
+}
+
+func (c *tConn) Send(protocol int, dstIA uint64, bytes []uint8) error {
+	data := transport.Encode(c.param.LocalIA, protocol, bytes)
+	if len(data) > 0xffff {
+		return errFrameTooLong
+	}
+	frame := make([]uint8, gLengthLen+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[gLengthLen:], data)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.param.WriteTimeout)); err != nil {
+		return err
+	}
+	n, err := c.conn.Write(frame)
+	if err == nil {
+		return nil
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if n == 0 {
+			return tWriteTimeoutError{}
+		}
+		// 字节流已经错位,只能断开连接.服务端连接的管道随之移除,客户端重连
+		c.conn.Close()
+		return errPartialWrite
+	}
+	return err
+}
+
+func (c *tConn) AllowSend() bool {
+	return true
+}
+
+func (c *tConn) Close() error {
+	return c.conn.Close()
+}
+
+// attach 把连接作为管道添加到端点.失败时关闭连接
+func attach(e *dcom.Endpoint, c *tConn) (dcom.ReceiveFunc, error) {
+	receive, err := e.AddPipe(c)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if c.param.OnConnect != nil {
+		c.param.OnConnect(c.id, c.conn.RemoteAddr())
+	}
+	return receive, nil
+}
+
+// serve 接收数据直到连接断开
+// 连接断开后从端点移除管道,管道上等待应答的调用以SystemErrorPipeClosed结束
+func serve(e *dcom.Endpoint, c *tConn, receive dcom.ReceiveFunc) {
+	readRun(c.conn, receive)
+
+	e.RemovePipe(c.id)
+	if c.param.OnDisconnect != nil {
+		c.param.OnDisconnect(c.id, c.conn.RemoteAddr())
+	}
+}
+
+// readRun 接收帧直到读出错
+func readRun(conn net.Conn, receive dcom.ReceiveFunc) {
+	header := make([]uint8, gLengthLen)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		data := make([]uint8, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		srcIA, protocol, frame, err := transport.Decode(data)
+		if err != nil {
+			continue
+		}
+		receive(protocol, srcIA, frame)
+	}
+}
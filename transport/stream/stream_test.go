@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+)
+
+func TestStreamReconnect(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, dcom.SystemOK
+	})
+	// 延迟应答的服务永不应答,用于测试连接断开时结束调用
+	b.RegisterHandler(0, 2, func(w dcom.ResponseWriter, req *dcom.Request) {
+		w.Defer()
+	})
+
+	server, err := Listen(b, "tcp", "127.0.0.1:0", &Param{LocalIA: 0x2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := server.Addr().String()
+	client, err := Dial(a, "tcp", address, &ClientParam{Param: Param{LocalIA: 0x1}, Pipe: 7,
+		ReconnectIntervalMin: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req := make([]uint8, 1000)
+	for i := range req {
+		req[i] = uint8(i)
+	}
+	resp, code := a.Call(0, 7, 0x2, 1, 3000, req)
+	if code != dcom.SystemOK || bytes.Equal(resp, req) == false {
+		t.Fatal("call over tcp failed", code, len(resp))
+	}
+
+	// 连接断开时等待应答的调用立即结束
+	pending := a.CallAsync(0, 7, 0x2, 2, 5000, []uint8{1})
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	server.Close()
+	<-pending.Done
+	if errors.Is(pending.Err, dcom.ErrPipeClosed) == false || time.Since(start) > time.Second {
+		t.Fatal("pending call should fail with pipe closed", pending.Err)
+	}
+
+	// 服务端恢复后客户端自动重连
+	server, err = Listen(b, "tcp", address, &Param{LocalIA: 0x2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, code = a.Call(0, 7, 0x2, 1, 200, []uint8{1})
+		if code == dcom.SystemOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client did not reconnect", code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStreamUnix(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	pipes := make(chan uint64, 10)
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		pipes <- pipe
+		return req, dcom.SystemOK
+	})
+	dir, err := ioutil.TempDir("", "dcom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "dcom.sock")
+	// 地址表和服务端从同一个端点分配管道号
+	tablePipe := b.NewPipeTable(false).Pipe(&net.UnixAddr{Name: address, Net: "unix"})
+	server, err := Listen(b, "unix", address, &Param{LocalIA: 0x2})
+	if err != nil {
+		t.Skip("unix socket is not available", err)
+	}
+	defer server.Close()
+
+	// Unix套接字接入的连接远端地址相同,每个连接仍然使用独立的管道
+	for _, pipe := range []uint64{7, 8} {
+		client, err := Dial(a, "unix", address, &ClientParam{Param: Param{LocalIA: 0x1}, Pipe: pipe})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	for _, pipe := range []uint64{7, 8, 7} {
+		resp, code := a.Call(0, pipe, 0x2, 1, 3000, []uint8{uint8(pipe)})
+		if code != dcom.SystemOK || len(resp) != 1 || resp[0] != uint8(pipe) {
+			t.Fatal("call over unix socket failed", pipe, code)
+		}
+	}
+	first, second, third := <-pipes, <-pipes, <-pipes
+	if first == second || first != third {
+		t.Fatal("connections should use their own pipes", first, second, third)
+	}
+	if first == tablePipe || second == tablePipe {
+		t.Fatal("connection pipe collides with pipe table", tablePipe)
+	}
+}
+
+func TestStreamWriteTimeout(t *testing.T) {
+	connA, connB := net.Pipe()
+	defer connB.Close()
+	c := &tConn{conn: connA, param: &Param{LocalIA: 0x1, WriteTimeout: 20 * time.Millisecond}}
+
+	// 对端不读取时发送超时返回临时错误
+	start := time.Now()
+	err := c.Send(0, 0x2, []uint8{1, 2, 3})
+	if temp, ok := err.(interface{ Temporary() bool }); ok == false || temp.Temporary() == false {
+		t.Fatal("write timeout should be temporary", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("send should not block")
+	}
+
+	// 只写入部分帧时断开连接
+	go connB.Read(make([]uint8, 1))
+	if err := c.Send(0, 0x2, []uint8{1, 2, 3}); err != errPartialWrite {
+		t.Fatal("partial write should close connection", err)
+	}
+	if _, err := connA.Write([]uint8{1}); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2021-2021 The jdh99 Authors. All rights reserved.
+// UDP传输模块.监听UDP地址,每个对端地址映射为一个管道.收到数据创建的管道空闲超时后移除
+// Authors: jdh99 <jdh821@163.com>
+
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+	"github.com/jdhxyy/dcom/transport"
+)
+
+// 默认参数
+const (
+	// 接收缓存.大于DCOM单帧最大长度加信封头部
+	gReadBufSize = 2048
+	// 读超时.到期后检查是否已关闭
+	gReadTimeout = time.Second
+	// 对端空闲超时
+	gIdleTimeout = 5 * time.Minute
+	// 收到数据创建的对端数上限
+	gPeersMax = 1024
+)
+
+// ErrClosed 传输已关闭
+var ErrClosed = errors.New("udp: transport closed")
+
+// ErrTooManyPeers 收到数据创建的对端数达到上限
+var ErrTooManyPeers = errors.New("udp: too many peers")
+
+// Param 传输参数
+type Param struct {
+	// 本机地址.发送的信封中携带此地址
+	LocalIA uint64
+	// 管道MTU.为0时使用DCOM默认值
+	MTU int
+	// 套接字收发缓存大小.为0时使用系统默认值
+	ReadBufferSize  int
+	WriteBufferSize int
+	// 读超时.为0时使用默认值1s
+	ReadTimeout time.Duration
+	// 对端空闲超时.收到数据创建的管道超过此时间没有收发时从端点移除.为0时使用默认值5min
+	IdleTimeout time.Duration
+	// 收到数据创建的对端数上限.达到上限后丢弃新地址的数据.为0时使用默认值1024
+	MaxPeers int
+}
+
+// Transport UDP传输
+type Transport struct {
+	e     *dcom.Endpoint
+	conn  *net.UDPConn
+	param Param
+
+	table *dcom.PipeTable
+	pipes map[uint64]*tPipe
+	// 收到数据创建的管道数
+	peerNum  int
+	mutex    sync.Mutex
+	isClosed bool
+	wg       sync.WaitGroup
+}
+
+// tPipe 对端管道
+type tPipe struct {
+	// 最近一次收发时间.单位:ns
+	// 原子操作的64位字段放在结构体开头,32位平台上才能保证8字节对齐
+	lastActive int64
+
+	t       *Transport
+	id      uint64
+	addr    *net.UDPAddr
+	receive dcom.ReceiveFunc
+	// 由应用通过Pipe创建.不会空闲超时
+	isPinned bool
+}
+
+// Listen 监听UDP地址并接入端点
+// addr格式与net.ResolveUDPAddr相同,比如":12025"或者"[::1]:12025".
+// IPv4对端的管道号与dcom.AddrToPipe兼容,其他对端由管道地址表分配
+func Listen(e *dcom.Endpoint, addr string, param *Param) (*Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if param.ReadBufferSize > 0 {
+		if err := conn.SetReadBuffer(param.ReadBufferSize); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if param.WriteBufferSize > 0 {
+		if err := conn.SetWriteBuffer(param.WriteBufferSize); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	t := &Transport{e: e, conn: conn, param: *param, pipes: make(map[uint64]*tPipe)}
+	t.table = e.NewPipeTable(true)
+	if t.param.ReadTimeout == 0 {
+		t.param.ReadTimeout = gReadTimeout
+	}
+	if t.param.IdleTimeout == 0 {
+		t.param.IdleTimeout = gIdleTimeout
+	}
+	if t.param.MaxPeers == 0 {
+		t.param.MaxPeers = gPeersMax
+	}
+	t.wg.Add(1)
+	go t.readRun()
+	return t, nil
+}
+
+// LocalAddr 本地监听地址
+func (t *Transport) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+// Pipe 获取对端地址对应的管道号.管道不存在时创建并添加到端点
+// 通过本函数获取的管道不会空闲超时,不计入对端数上限
+func (t *Transport) Pipe(addr *net.UDPAddr) (uint64, error) {
+	p, err := t.getPipe(addr, true)
+	if err != nil {
+		return 0, err
+	}
+	return p.id, nil
+}
+
+// Addr 管道号对应的对端地址.管道号不存在时返回false
+func (t *Transport) Addr(pipe uint64) (net.Addr, bool) {
+	return t.table.Addr(pipe)
+}
+
+// getPipe 获取对端地址对应的管道.不存在时创建.isPinned为true时管道不会空闲超时
+func (t *Transport) getPipe(addr *net.UDPAddr, isPinned bool) (*tPipe, error) {
+	id := t.table.Pipe(addr)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.isClosed {
+		return nil, ErrClosed
+	}
+	if p, ok := t.pipes[id]; ok {
+		if isPinned && p.isPinned == false {
+			p.isPinned = true
+			t.peerNum--
+		}
+		p.touch()
+		return p, nil
+	}
+	if isPinned == false && t.peerNum >= t.param.MaxPeers {
+		t.table.Remove(id)
+		return nil, ErrTooManyPeers
+	}
+	p := &tPipe{t: t, id: id, addr: addr, isPinned: isPinned}
+	p.touch()
+	receive, err := t.e.AddPipe(p)
+	if err != nil {
+		t.table.Remove(id)
+		return nil, err
+	}
+	p.receive = receive
+	t.pipes[id] = p
+	if isPinned == false {
+		t.peerNum++
+	}
+	return p, nil
+}
+
+// expire 移除空闲超时的管道
+func (t *Transport) expire() {
+	deadline := time.Now().Add(-t.param.IdleTimeout).UnixNano()
+	var ids []uint64
+	t.mutex.Lock()
+	for id, p := range t.pipes {
+		if p.isPinned == false && atomic.LoadInt64(&p.lastActive) < deadline {
+			ids = append(ids, id)
+			delete(t.pipes, id)
+			t.peerNum--
+			t.table.Remove(id)
+		}
+	}
+	t.mutex.Unlock()
+
+	// 管道上等待应答的调用以SystemErrorPipeClosed结束
+	for _, id := range ids {
+		t.e.RemovePipe(id)
+	}
+}
+
+// readRun 接收线程
+func (t *Transport) readRun() {
+	defer t.wg.Done()
+
+	buf := make([]uint8, gReadBufSize)
+	lastExpire := time.Now()
+	for {
+		if err := t.conn.SetReadDeadline(time.Now().Add(t.param.ReadTimeout)); err != nil {
+			return
+		}
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if t.closed() {
+			return
+		}
+		if time.Since(lastExpire) >= t.param.ReadTimeout {
+			lastExpire = time.Now()
+			t.expire()
+		}
+		if err != nil {
+			continue
+		}
+
+		// 只为有效的DCOM帧创建管道
+		srcIA, protocol, frame, err := transport.Decode(buf[:n])
+		if err != nil || dcom.IsFrame(frame) == false {
+			continue
+		}
+		p, err := t.getPipe(addr, false)
+		if err != nil {
+			continue
+		}
+		data := make([]uint8, len(frame))
+		copy(data, frame)
+		p.receive(protocol, srcIA, data)
+	}
+}
+
+func (t *Transport) closed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.isClosed
+}
+
+// Close 关闭传输.从端点移除所有管道并关闭套接字
+func (t *Transport) Close() error {
+	t.mutex.Lock()
+	if t.isClosed {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.isClosed = true
+	var ids []uint64
+	for id := range t.pipes {
+		ids = append(ids, id)
+	}
+	t.mutex.Unlock()
+
+	for _, id := range ids {
+		t.e.RemovePipe(id)
+	}
+	err := t.conn.Close()
+	t.wg.Wait()
+	return err
+}
+
+func (p *tPipe) ID() uint64 {
+	return p.id
+}
+
+func (p *tPipe) MTU() int {
+	return p.t.param.MTU
+}
+
+// touch 记录收发时间
+func (p *tPipe) touch() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+func (p *tPipe) Send(protocol int, dstIA uint64, bytes []uint8) error {
+	p.touch()
+	_, err := p.t.conn.WriteToUDP(transport.Encode(p.t.param.LocalIA, protocol, bytes), p.addr)
+	return err
+}
+
+func (p *tPipe) AllowSend() bool {
+	return true
+}
+
+func (p *tPipe) Close() error {
+	p.t.mutex.Lock()
+	defer p.t.mutex.Unlock()
+	if p.t.pipes[p.id] == p {
+		delete(p.t.pipes, p.id)
+		if p.isPinned == false {
+			p.t.peerNum--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jdhxyy/dcom"
+	"github.com/jdhxyy/dcom/transport"
+)
+
+func TestUdp(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	ta, err := Listen(a, "127.0.0.1:0", &Param{LocalIA: 0x1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ta.Close()
+	tb, err := Listen(b, "127.0.0.1:0", &Param{LocalIA: 0x2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		if srcIA != 0x1 {
+			return nil, dcom.SystemErrorParamInvalid
+		}
+		return req, dcom.SystemOK
+	})
+
+	pipe, err := ta.Pipe(tb.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := make([]uint8, 1000)
+	for i := range req {
+		req[i] = uint8(i)
+	}
+	resp, code := a.Call(0, pipe, 0x2, 1, 3000, req)
+	if code != dcom.SystemOK || len(resp) != len(req) || resp[999] != req[999] {
+		t.Fatal("call over udp failed", code, len(resp))
+	}
+
+	ta.Close()
+	if _, err := ta.Pipe(tb.LocalAddr().(*net.UDPAddr)); err != ErrClosed {
+		t.Fatal("pipe after close should fail", err)
+	}
+}
+
+func TestUdpIPv6(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	a := dcom.NewEndpoint(&param)
+	b := dcom.NewEndpoint(&param)
+	defer a.Close(context.Background())
+	defer b.Close(context.Background())
+
+	ta, err := Listen(a, "[::1]:0", &Param{LocalIA: 0x1})
+	if err != nil {
+		t.Skip("ipv6 loopback is not available", err)
+	}
+	defer ta.Close()
+	tb, err := Listen(b, "[::1]:0", &Param{LocalIA: 0x2})
+	if err != nil {
+		t.Skip("ipv6 loopback is not available", err)
+	}
+	defer tb.Close()
+
+	b.Register(0, 1, func(pipe uint64, srcIA uint64, req []uint8) ([]uint8, int) {
+		return req, dcom.SystemOK
+	})
+	addrB := tb.LocalAddr().(*net.UDPAddr)
+	pipe, err := ta.Pipe(addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := ta.Addr(pipe)
+	if ok == false || addr.String() != addrB.String() {
+		t.Fatal("resolve pipe failed", addr)
+	}
+	resp, code := a.Call(0, pipe, 0x2, 1, 3000, []uint8{1, 2, 3})
+	if code != dcom.SystemOK || len(resp) != 3 {
+		t.Fatal("call over ipv6 failed", code)
+	}
+}
+
+func TestUdpPeerLimit(t *testing.T) {
+	var param dcom.LoadParam
+	param.BlockRetryMaxNum = 5
+	param.BlockRetryInterval = 100
+	b := dcom.NewEndpoint(&param)
+	defer b.Close(context.Background())
+	tb, err := Listen(b, "127.0.0.1:0", &Param{LocalIA: 0x2, ReadTimeout: 20 * time.Millisecond,
+		IdleTimeout: 200 * time.Millisecond, MaxPeers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	var conns []*net.UDPConn
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialUDP("udp", nil, tb.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// 不是DCOM帧的数据不创建管道
+	conns[0].Write(transport.Encode(0x1, 0, []uint8{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}))
+	time.Sleep(50 * time.Millisecond)
+	if n := testPeerNum(tb); n != 0 {
+		t.Fatal("invalid frame should not create pipe", n)
+	}
+
+	// NON帧,rid为1,载荷1个字节
+	frame := []uint8{0x20, 0x04, 0x00, 0x01, 0x01}
+	for _, conn := range conns {
+		conn.Write(transport.Encode(0x1, 0, frame))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := testPeerNum(tb); n != 2 {
+		t.Fatal("peer num should be limited", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testPeerNum(tb) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := testPeerNum(tb); n != 0 {
+		t.Fatal("idle peer should expire", n)
+	}
+}
+
+func testPeerNum(t *Transport) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pipes)
+}
@@ -4,35 +4,32 @@
 
 package dcom
 
-// gSend 发送数据
-func gSend(protocol int, pipe uint64, dstIA uint64, frame *tFrame) {
+// send 发送数据.返回管道的发送错误
+func (e *Endpoint) send(protocol int, pipe uint64, dstIA uint64, frame *tFrame) error {
+	return e.sendPriority(protocol, pipe, dstIA, frame, 0)
+}
+
+// sendPriority 按优先级发送数据.管道发送队列中优先级高的帧先发送.返回管道的发送错误
+func (e *Endpoint) sendPriority(protocol int, pipe uint64, dstIA uint64, frame *tFrame, priority int) error {
 	if frame == nil {
-		return
-	}
-	if gParam.IsAllowSend(pipe) == false {
-		logWarn("send failed!pipe:0x%x is not allow send.token:%d", pipe, frame.controlWord.token)
-		return
+		return nil
 	}
 	logInfo("send frame.token:%d protocol:%d pipe:0x%x dst ia:0x%x", frame.controlWord.token, protocol, pipe, dstIA)
-	gParam.Send(protocol, pipe, dstIA, gFrameToBytes(frame))
+	return e.transmit(protocol, pipe, dstIA, gFrameToBytes(frame), priority)
 }
 
-// gBlockSend 块传输发送数据
-func gBlockSend(protocol int, pipe uint64, dstIA uint64, frame *tBlockFrame) {
+// blockSend 块传输发送数据.priority是发送队列中的优先级.返回管道的发送错误
+func (e *Endpoint) blockSend(protocol int, pipe uint64, dstIA uint64, frame *tBlockFrame, priority int) error {
 	if frame == nil {
-		return
-	}
-	if gParam.IsAllowSend(pipe) == false {
-		logWarn("block send failed!pipe:0x%x is not allow send.token:%d", pipe, frame.controlWord.token)
-		return
+		return nil
 	}
 	logInfo("block send frame.token:%d protocol:%d pipe:0x%x dst ia:0x%x offset:%d", frame.controlWord.token,
 		protocol, pipe, dstIA, frame.blockHeader.offset)
-	gParam.Send(protocol, pipe, dstIA, gBlockFrameToBytes(frame))
+	return e.transmit(protocol, pipe, dstIA, gBlockFrameToBytes(frame), priority)
 }
 
-// gSendRstFrame 发送错误码
-func gSendRstFrame(protocol int, pipe uint64, dstIA uint64, errorCode int, rid int, token int) {
+// sendRstFrame 发送错误码.返回管道的发送错误
+func (e *Endpoint) sendRstFrame(protocol int, pipe uint64, dstIA uint64, errorCode int, rid int, token int) error {
 	logInfo("send rst frame:0x%x!token:%d protocol:%d pipe:0x%x dst ia:0x%x", errorCode, token, protocol, pipe,
 		dstIA)
 	var frame tFrame
@@ -43,5 +40,5 @@ func gSendRstFrame(protocol int, pipe uint64, dstIA uint64, errorCode int, rid i
 	frame.controlWord.payloadLen = 1
 	frame.payload = make([]uint8, 1)
 	frame.payload[0] = uint8(errorCode) | 0x80
-	gSend(protocol, pipe, dstIA, &frame)
+	return e.send(protocol, pipe, dstIA, &frame)
 }
@@ -5,7 +5,8 @@
 package dcom
 
 import (
-	"container/list"
+	"context"
+	"math"
 	"sync"
 	"time"
 )
@@ -13,12 +14,25 @@ import (
 // Resp 异步调用应答
 type Resp struct {
 	Error int
+	// Err 调用失败时的错误详情.调用成功为nil
+	Err   error
 	Bytes []uint8
 	Done  chan *Resp
+
+	rid      int
+	token    int
+	ia       uint64
+	isRemote bool
+	// 底层错误
+	cause error
 }
 
 // done 结果返回.框架内调用
 func (resp *Resp) done() {
+	if resp.Error != SystemOK {
+		resp.Err = &Error{Code: resp.Error, IsRemote: resp.isRemote, Rid: resp.rid, Token: resp.token, IA: resp.ia,
+			Cause: resp.cause}
+	}
 	select {
 	case resp.Done <- resp:
 	default:
@@ -33,6 +47,8 @@ type tWaitItem struct {
 	pipe      uint64
 	timeoutUs int64
 	req       []uint8
+	// 请求是否需要块传输
+	isBlock bool
 
 	dstIA uint64
 	rid   int
@@ -42,85 +58,194 @@ type tWaitItem struct {
 	startTime int64
 	// 上次发送时间戳.单位:us.用于重传
 	lastRetryTimestamp int64
-	retryNum           int
-	code               int
+	// 本次重传间隔.单位:us
+	retryInterval int64
+	retryNum      int
+	code          int
+
+	opts *tCallOptions
+
+	key   tExchangeKey
+	timer *tTimer
 }
 
-var waitItems list.List
-var waitItemsMutex sync.Mutex
+// tWaitShard 等待队列分片
+type tWaitShard struct {
+	items map[tExchangeKey]*tWaitItem
+	mutex sync.Mutex
+}
 
-func init() {
-	go checkWaitItemsThread()
+// tWaitTable 等待队列.按会话关键字索引
+type tWaitTable struct {
+	shards [gShardNum]tWaitShard
 }
 
-// checkWaitItems 检查等待列表线程
-// 检查项有重发,超时等
-func checkWaitItemsThread() {
-	for {
-		checkWaitItems()
-		time.Sleep(time.Millisecond)
+// 节点检查结果
+const (
+	gWaitKeep = iota
+	gWaitRetry
+	gWaitTimeout
+)
+
+func (t *tWaitTable) init() {
+	for i := range t.shards {
+		t.shards[i].items = make(map[tExchangeKey]*tWaitItem)
 	}
 }
 
-func checkWaitItems() {
-	waitItemsMutex.Lock()
-	defer waitItemsMutex.Unlock()
+func (t *tWaitTable) shard(key *tExchangeKey) *tWaitShard {
+	return &t.shards[shardIndex(key)]
+}
+
+// len 节点数
+func (t *tWaitTable) len() int {
+	num := 0
+	for i := range t.shards {
+		t.shards[i].mutex.Lock()
+		num += len(t.shards[i].items)
+		t.shards[i].mutex.Unlock()
+	}
+	return num
+}
 
-	node := waitItems.Front()
-	var nodeNext *list.Element
-	for {
-		if node == nil {
-			break
+// waitItemSchedule 调度节点的下一次检查
+// 检查时刻是总超时和下一次重传中较早的时刻
+func (e *Endpoint) waitItemSchedule(item *tWaitItem) {
+	at := deadlineAdd(item.startTime, item.timeoutUs)
+	// 块传输不用此处重传.块传输模块自己负责
+	if item.isBlock == false {
+		retryTime := item.lastRetryTimestamp + item.retryInterval
+		if retryTime < at {
+			at = retryTime
 		}
-		nodeNext = node.Next()
-		retrySend(node)
-		node = nodeNext
 	}
+	e.scheduler.schedule(item.timer, at)
 }
 
-func retrySend(node *list.Element) {
-	item := node.Value.(*tWaitItem)
-	t := gGetTime()
-	if t-item.startTime > item.timeoutUs {
-		logWarn("wait ack timeout!task failed!token:%d", item.token)
-		waitItems.Remove(node)
-		if len(item.req) > gSingleFrameSizeMax {
-			gBlockRemove(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token)
+// waitItemTimeout 节点定时器到期处理.检查项有重发,超时等
+func (e *Endpoint) waitItemTimeout(item *tWaitItem) {
+	sh := e.waitItems.shard(&item.key)
+	sh.mutex.Lock()
+	if sh.items[item.key] != item {
+		sh.mutex.Unlock()
+		return
+	}
+	result := e.checkRetry(item)
+	if result == gWaitTimeout {
+		e.waitItemsRemove(sh, item)
+	} else {
+		e.waitItemSchedule(item)
+	}
+	sh.mutex.Unlock()
+
+	// 重传和结束调用在锁外进行,避免发送函数中同步接收应答时死锁
+	if result == gWaitTimeout {
+		if item.isBlock {
+			e.blockRemove(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token)
 		}
 		item.resp.Error = SystemErrorRxTimeout
 		item.end <- true
 		return
 	}
+	if result == gWaitRetry {
+		logWarn("retry send.token:%d retry num:%d", item.token, item.retryNum)
+		err := e.waitlistSendFrame(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token, item.req,
+			item.opts)
+		e.dealSendError(item, err)
+	}
+}
+
+// dealSendError 处理发送错误
+// 临时错误计为一次重传,由重传机制继续发送.其他错误使调用立即失败
+func (e *Endpoint) dealSendError(item *tWaitItem, err error) {
+	if err == nil {
+		return
+	}
+	if isTemporary(err) {
+		logWarn("send failed with temporary error:%v.wait retry.token:%d", err, item.token)
+		return
+	}
+	e.failWaitItem(&item.key, SystemErrorSendFailed, err)
+}
 
-	// 块传输不用此处重传.块传输模块自己负责
-	if len(item.req) > gSingleFrameSizeMax {
+// failWaitItem 以错误码结束等待队列中的调用.节点不存在时忽略
+func (e *Endpoint) failWaitItem(key *tExchangeKey, code int, cause error) {
+	item := e.waitItemsTake(key)
+	if item == nil {
 		return
 	}
+	logWarn("call failed:0x%x cause:%v.token:%d", code, cause, item.token)
+	if item.isBlock {
+		e.blockRemove(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token)
+	}
+	item.resp.Error = code
+	item.resp.cause = cause
+	item.end <- true
+}
+
+// waitItemBlockSent 请求的块传输结束且数据已全部发送
+// 块传输请求不重传,没有截止时间的调用从此时起最多再等待timeoutUs接收应答.单位:us
+func (e *Endpoint) waitItemBlockSent(key *tExchangeKey, timeoutUs int64) {
+	sh := e.waitItems.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
 
-	if t-item.lastRetryTimestamp < int64(gParam.BlockRetryInterval*1000) {
+	item, ok := sh.items[*key]
+	if ok == false || item.timeoutUs != gTimeMax {
 		return
 	}
+	item.timeoutUs = e.getTime() - item.startTime + timeoutUs
+	e.waitItemSchedule(item)
+}
+
+// checkRetry 检查节点超时和重传
+func (e *Endpoint) checkRetry(item *tWaitItem) int {
+	t := e.getTime()
+	if t-item.startTime >= item.timeoutUs {
+		logWarn("wait ack timeout!task failed!token:%d", item.token)
+		return gWaitTimeout
+	}
+
+	// 块传输不用此处重传.块传输模块自己负责
+	if item.isBlock {
+		return gWaitKeep
+	}
+
+	if t-item.lastRetryTimestamp < item.retryInterval {
+		return gWaitKeep
+	}
 
 	// 重传
 	item.retryNum++
-	if item.retryNum >= gParam.BlockRetryMaxNum {
+	if item.retryNum >= item.opts.retryMaxNum {
 		logWarn("retry too many!task failed!token:%d", item.token)
-		waitItems.Remove(node)
-		item.resp.Error = SystemErrorRxTimeout
-		item.end <- true
-		return
+		return gWaitTimeout
 	}
 	item.lastRetryTimestamp = t
-	logWarn("retry send.token:%d retry num:%d", item.token, item.retryNum)
-	waitlistSendFrame(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token, item.req)
+	item.retryInterval = e.optionRetryInterval(item.opts, item.pipe, item.dstIA, item.retryNum)
+	return gWaitRetry
 }
 
 // Call RPC同步调用
 // timeout是超时时间,单位:ms.为0表示不需要应答
 // 返回值是应答字节流和错误码.错误码非SystemOK表示调用失败
 func Call(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) ([]uint8, int) {
+	return defaultEndpoint.Call(protocol, pipe, dstIA, rid, timeout, req)
+}
+
+// CallAsync RPC异步调用
+// timeout是超时时间,单位:ms.为0表示不需要应答
+// 返回值中错误码非SystemOK表示调用失败
+func CallAsync(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) *Resp {
+	return defaultEndpoint.CallAsync(protocol, pipe, dstIA, rid, timeout, req)
+}
+
+// Call RPC同步调用
+// timeout是超时时间,单位:ms.为0表示不需要应答
+// 返回值是应答字节流和错误码.错误码非SystemOK表示调用失败
+func (e *Endpoint) Call(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) ([]uint8, int) {
 	logInfo("call.protocol:%d pipe:0x%x dst ia:0x%x rid:%d timeout:%d", protocol, pipe, dstIA, rid, timeout)
-	resp := CallAsync(protocol, pipe, dstIA, rid, timeout, req)
+	resp := e.CallAsync(protocol, pipe, dstIA, rid, timeout, req)
 	<-resp.Done
 	logInfo("call resp.result:%d len:%d", resp.Error, len(resp.Bytes))
 	return resp.Bytes, resp.Error
@@ -129,66 +254,315 @@ func Call(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []u
 // CallAsync RPC异步调用
 // timeout是超时时间,单位:ms.为0表示不需要应答
 // 返回值中错误码非SystemOK表示调用失败
-func CallAsync(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) *Resp {
+func (e *Endpoint) CallAsync(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) *Resp {
+	param := e.getParam()
+	opts := newCallOptions(&param, nil)
+	opts.isNon = timeout == 0
+	return e.callAsync(context.Background(), protocol, pipe, dstIA, rid, int64(timeout)*1000, req, opts)
+}
+
+// CallContext RPC同步调用
+// 超时时间由ctx的截止时间决定,没有截止时间则直到重传次数用尽.ctx取消时调用立即结束,
+// 截止时间到达返回SystemErrorRxTimeout,取消返回SystemErrorCanceled
+func CallContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int, req []uint8,
+	opts ...CallOption) ([]uint8, int) {
+	return defaultEndpoint.CallContext(ctx, protocol, pipe, dstIA, rid, req, opts...)
+}
+
+// CallAsyncContext RPC异步调用
+// 超时时间由ctx的截止时间决定,没有截止时间则直到重传次数用尽
+func CallAsyncContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int, req []uint8,
+	opts ...CallOption) *Resp {
+	return defaultEndpoint.CallAsyncContext(ctx, protocol, pipe, dstIA, rid, req, opts...)
+}
+
+// CallContext RPC同步调用
+// 超时时间由ctx的截止时间决定,没有截止时间则直到重传次数用尽.ctx取消时调用立即结束,
+// 截止时间到达返回SystemErrorRxTimeout,取消返回SystemErrorCanceled
+func (e *Endpoint) CallContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int,
+	req []uint8, opts ...CallOption) ([]uint8, int) {
+	logInfo("call context.protocol:%d pipe:0x%x dst ia:0x%x rid:%d", protocol, pipe, dstIA, rid)
+	resp := e.CallAsyncContext(ctx, protocol, pipe, dstIA, rid, req, opts...)
+	<-resp.Done
+	logInfo("call context resp.result:%d len:%d", resp.Error, len(resp.Bytes))
+	return resp.Bytes, resp.Error
+}
+
+// CallAsyncContext RPC异步调用
+// 超时时间由ctx的截止时间决定,没有截止时间则直到重传次数用尽
+func (e *Endpoint) CallAsyncContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int,
+	req []uint8, opts ...CallOption) *Resp {
+	timeoutUs := int64(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		// 截止时间按端点时钟计算
+		timeoutUs = int64(deadline.Sub(e.getClock().Now()) / time.Microsecond)
+	}
+	param := e.getParam()
+	return e.callAsync(ctx, protocol, pipe, dstIA, rid, timeoutUs, req, newCallOptions(&param, opts))
+}
+
+// Invoke RPC同步调用
+// 与Call相同,调用失败时返回*Error
+func Invoke(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) ([]uint8, error) {
+	return defaultEndpoint.Invoke(protocol, pipe, dstIA, rid, timeout, req)
+}
+
+// InvokeContext RPC同步调用
+// 与CallContext相同,调用失败时返回*Error
+func InvokeContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int, req []uint8,
+	opts ...CallOption) ([]uint8, error) {
+	return defaultEndpoint.InvokeContext(ctx, protocol, pipe, dstIA, rid, req, opts...)
+}
+
+// Invoke RPC同步调用
+// 与Call相同,调用失败时返回*Error
+func (e *Endpoint) Invoke(protocol int, pipe uint64, dstIA uint64, rid int, timeout int, req []uint8) ([]uint8,
+	error) {
+	resp := e.CallAsync(protocol, pipe, dstIA, rid, timeout, req)
+	<-resp.Done
+	return resp.Bytes, resp.Err
+}
+
+// InvokeContext RPC同步调用
+// 与CallContext相同,调用失败时返回*Error
+func (e *Endpoint) InvokeContext(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int,
+	req []uint8, opts ...CallOption) ([]uint8, error) {
+	resp := e.CallAsyncContext(ctx, protocol, pipe, dstIA, rid, req, opts...)
+	<-resp.Done
+	return resp.Bytes, resp.Err
+}
+
+func (e *Endpoint) callAsync(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int, timeoutUs int64,
+	req []uint8, opts *tCallOptions) *Resp {
 	var resp Resp
 	resp.Done = make(chan *Resp, 10)
+	resp.rid = rid
+	resp.ia = dstIA
+
+	if e.isRunning() == false {
+		logWarn("call async failed!endpoint is not running.dst ia:0x%x rid:%d", dstIA, rid)
+		resp.Error = SystemErrorShutdown
+		resp.done()
+		return &resp
+	}
+	if ctx.Err() != nil {
+		resp.Error = contextErrorCode(ctx.Err())
+		resp.done()
+		return &resp
+	}
+
+	waiter, result := e.inflightAcquire(pipe, dstIA, opts.priority)
+	if result != SystemOK {
+		resp.Error = result
+		resp.done()
+		return &resp
+	}
+	if waiter == nil {
+		e.callStart(ctx, protocol, pipe, dstIA, rid, timeoutUs, req, opts, &resp)
+		return &resp
+	}
+
+	// 超过在途上限.等待时间计入超时时间
+	wait := func() {
+		startTime := e.getTime()
+		result := e.inflightWait(ctx, waiter, timeoutUs)
+		if result != SystemOK {
+			resp.Error = result
+			resp.done()
+			return
+		}
+		if timeoutUs < gTimeMax {
+			timeoutUs -= e.getTime() - startTime
+		}
+		e.callStart(ctx, protocol, pipe, dstIA, rid, timeoutUs, req, opts, &resp)
+	}
+	if e.getParam().InflightPolicy == InflightPolicyQueue {
+		go wait()
+	} else {
+		wait()
+	}
+	return &resp
+}
 
+// callStart 已占用在途名额,分配token并发送请求
+func (e *Endpoint) callStart(ctx context.Context, protocol int, pipe uint64, dstIA uint64, rid int, timeoutUs int64,
+	req []uint8, opts *tCallOptions, resp *Resp) {
 	code := gCodeCon
-	if timeout == 0 {
+	if opts.isNon {
 		code = gCodeNon
 	}
 
-	token := gGetToken()
-	logInfo("call async.token:%d protocol:%d pipe:0x%x dst ia:0x%x rid:%d timeout:%d", token, protocol, pipe,
-		dstIA, rid, timeout)
-	waitlistSendFrame(protocol, pipe, dstIA, code, rid, token, req)
+	if len(req) > e.frameSizeMax(pipe) && e.blockTxIsSizeValid(pipe, len(req)) == false {
+		logWarn("call async failed!req len is invalid:%d.pipe:0x%x dst ia:0x%x rid:%d", len(req), pipe, dstIA, rid)
+		e.inflightRelease(pipe, dstIA)
+		resp.Error = SystemErrorParamInvalid
+		resp.done()
+		return
+	}
+
+	// 名额随token全部引用释放而归还
+	token, ok := e.allocToken(pipe, dstIA)
+	if ok == false {
+		logWarn("call async failed!token exhausted.pipe:0x%x dst ia:0x%x rid:%d", pipe, dstIA, rid)
+		e.inflightRelease(pipe, dstIA)
+		resp.Error = SystemErrorTokenExhausted
+		resp.done()
+		return
+	}
 
 	if code == gCodeNon {
+		resp.token = token
+		logInfo("call async.token:%d protocol:%d pipe:0x%x dst ia:0x%x rid:%d non", token, protocol, pipe, dstIA, rid)
+		// 块传输发送队列接管token引用,单帧发送后即可释放
+		err := e.waitlistSendFrame(protocol, pipe, dstIA, code, rid, token, req, opts)
+		if len(req) <= e.frameSizeMax(pipe) {
+			e.releaseToken(pipe, dstIA, token)
+		}
 		resp.Error = SystemOK
+		if err != nil {
+			resp.Error = SystemErrorSendFailed
+			resp.cause = err
+		}
+		timer := e.getClock().NewTimer(time.Millisecond)
 		go func() {
-			select {
-			case <-time.After(time.Millisecond):
-				resp.done()
-			}
+			<-timer.C()
+			resp.done()
 		}()
-		return &resp
+		return
 	}
 
 	var item tWaitItem
-	item.resp = &resp
-	item.end = make(chan bool)
+	item.resp = resp
+	item.end = make(chan bool, 1)
+	item.protocol = protocol
 	item.pipe = pipe
-	item.timeoutUs = int64(timeout) * 1000
+	item.timeoutUs = timeoutUs
 	item.req = req
+	item.isBlock = len(req) > e.frameSizeMax(pipe)
 
 	item.dstIA = dstIA
 	item.rid = rid
 	item.token = token
 	item.code = code
+	item.opts = opts
+	item.timer = newTimer(opts.priority, func() {
+		e.waitItemTimeout(&item)
+	})
 
 	item.retryNum = 0
-	item.startTime = gGetTime()
-	item.lastRetryTimestamp = gGetTime()
+	item.startTime = e.getTime()
+	item.lastRetryTimestamp = e.getTime()
+	item.retryInterval = e.optionRetryInterval(opts, pipe, dstIA, 0)
 
-	waitItemsMutex.Lock()
-	waitItems.PushBack(&item)
-	waitItemsMutex.Unlock()
+	// 块传输发送队列单独持有token引用
+	if item.isBlock {
+		e.holdToken(pipe, dstIA, token)
+	}
+	// 先加入等待队列再发送,避免应答先于节点入队到达
+	e.waitItemsInsert(&item)
+	resp.token = token
+	logInfo("call async.token:%d protocol:%d pipe:0x%x dst ia:0x%x rid:%d timeout:%dus", item.token, protocol,
+		pipe, dstIA, rid, timeoutUs)
 
 	// 等待数据
 	go func() {
 		select {
 		case <-item.end:
-			item.resp.done()
+		case <-ctx.Done():
+			e.cancelWaitItem(&item, ctx.Err())
 		}
+		item.resp.done()
 	}()
-	return &resp
+
+	err := e.waitlistSendFrame(protocol, pipe, dstIA, code, rid, item.token, req, opts)
+	e.dealSendError(&item, err)
 }
 
-func waitlistSendFrame(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int, data []uint8) {
-	if len(data) > gSingleFrameSizeMax {
-		gBlockTx(protocol, pipe, dstIA, code, rid, token, data)
+// cancelWaitItem 因ctx结束而取消调用
+// 节点已被其他模块结束时等待其结果
+func (e *Endpoint) cancelWaitItem(item *tWaitItem, err error) {
+	sh := e.waitItems.shard(&item.key)
+	sh.mutex.Lock()
+	if sh.items[item.key] != item {
+		sh.mutex.Unlock()
+		<-item.end
 		return
 	}
+	e.waitItemsRemove(sh, item)
+	sh.mutex.Unlock()
+
+	logWarn("call canceled:%v.token:%d", err, item.token)
+	item.resp.Error = contextErrorCode(err)
+	if item.isBlock {
+		e.blockRemove(item.protocol, item.pipe, item.dstIA, item.code, item.rid, item.token)
+	}
+	if e.getParam().IsSendRstOnCancel {
+		// 通知对端停止处理,包括停止块传输发送应答
+		e.sendRstFrame(item.protocol, item.pipe, item.dstIA, SystemErrorCanceled, item.rid, item.token)
+	}
+}
+
+// contextErrorCode ctx错误转换为错误码
+func contextErrorCode(err error) int {
+	if err == context.DeadlineExceeded {
+		return SystemErrorRxTimeout
+	}
+	return SystemErrorCanceled
+}
+
+// shutdownWaitItems 以关闭错误码结束等待队列中所有调用
+func (e *Endpoint) shutdownWaitItems() {
+	for i := range e.waitItems.shards {
+		sh := &e.waitItems.shards[i]
+		sh.mutex.Lock()
+		for _, item := range sh.items {
+			logWarn("endpoint shutdown!task failed!token:%d", item.token)
+			e.waitItemsRemove(sh, item)
+			item.resp.Error = SystemErrorShutdown
+			item.end <- true
+		}
+		sh.mutex.Unlock()
+	}
+}
+
+// waitItemsInsert 加入等待队列,同时调度节点.节点的token已分配
+func (e *Endpoint) waitItemsInsert(item *tWaitItem) {
+	item.key = tExchangeKey{protocol: item.protocol, pipe: item.pipe, ia: item.dstIA, rid: item.rid,
+		token: item.token}
+	sh := e.waitItems.shard(&item.key)
+	sh.mutex.Lock()
+	sh.items[item.key] = item
+	e.waitItemSchedule(item)
+	sh.mutex.Unlock()
+}
+
+// waitItemsRemove 从等待队列删除节点,取消定时器并释放token.调用者需持有分片锁
+func (e *Endpoint) waitItemsRemove(sh *tWaitShard, item *tWaitItem) {
+	delete(sh.items, item.key)
+	e.scheduler.cancel(item.timer)
+	e.releaseToken(item.pipe, item.dstIA, item.token)
+}
+
+// waitItemsTake 取出会话对应的节点.不存在时返回nil
+func (e *Endpoint) waitItemsTake(key *tExchangeKey) *tWaitItem {
+	sh := e.waitItems.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	item, ok := sh.items[*key]
+	if ok == false {
+		return nil
+	}
+	e.waitItemsRemove(sh, item)
+	return item
+}
+
+// waitlistSendFrame 发送请求.返回管道的发送错误
+func (e *Endpoint) waitlistSendFrame(protocol int, pipe uint64, dstIA uint64, code int, rid int, token int,
+	data []uint8, opts *tCallOptions) error {
+	if len(data) > e.frameSizeMax(pipe) {
+		return e.blockTx(protocol, pipe, dstIA, code, rid, token, data, opts)
+	}
 
 	var frame tFrame
 	frame.controlWord.code = code
@@ -198,76 +572,48 @@ func waitlistSendFrame(protocol int, pipe uint64, dstIA uint64, code int, rid in
 	frame.controlWord.payloadLen = len(data)
 	frame.payload = append(frame.payload, data...)
 	logInfo("send frame.token:%d", token)
-	gSend(protocol, pipe, dstIA, &frame)
+	return e.sendPriority(protocol, pipe, dstIA, &frame, opts.priority)
 }
 
-// gRxAckFrame 接收到ACK帧时处理函数
-func gRxAckFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
-	waitItemsMutex.Lock()
-	defer waitItemsMutex.Unlock()
-
+// rxAckFrame 接收到ACK帧时处理函数
+func (e *Endpoint) rxAckFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 	logInfo("rx ack frame.src ia:0x%x", srcIA)
-	node := waitItems.Front()
-	var nodeNext *list.Element
-	for {
-		if node == nil {
-			break
-		}
-		nodeNext = node.Next()
-		if checkNodeAndDealAckFrame(protocol, pipe, srcIA, frame, node) {
-			break
-		}
-		node = nodeNext
-	}
-}
-
-func checkNodeAndDealAckFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame, node *list.Element) bool {
-	item := node.Value.(*tWaitItem)
-	if item.protocol != protocol || item.pipe != pipe || item.dstIA != srcIA || item.rid != frame.controlWord.rid ||
-		item.token != frame.controlWord.token {
-		return false
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	item := e.waitItemsTake(&key)
+	if item == nil {
+		return
 	}
 
 	logInfo("deal ack frame.token:%d", item.token)
-	waitItems.Remove(node)
+	if item.retryNum == 0 && item.isBlock == false {
+		e.rttSample(item.pipe, item.dstIA, e.getTime()-item.startTime)
+	}
 	item.resp.Bytes = append(item.resp.Bytes, frame.payload...)
 	item.resp.Error = SystemOK
 	item.end <- true
-	return true
 }
 
-// gRxRstFrame 接收到RST帧时处理函数
-func gRxRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
-	waitItemsMutex.Lock()
-	defer waitItemsMutex.Unlock()
-
+// rxRstFrame 接收到RST帧时处理函数
+func (e *Endpoint) rxRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame) {
 	logWarn("rx rst frame.src ia:0x%x", srcIA)
-	node := waitItems.Front()
-	var nodeNext *list.Element
-	for {
-		if node == nil {
-			break
-		}
-		nodeNext = node.Next()
-		if dealRstFrame(protocol, pipe, srcIA, frame, node) {
-			break
-		}
-		node = nodeNext
+	key := tExchangeKey{protocol: protocol, pipe: pipe, ia: srcIA, rid: frame.controlWord.rid,
+		token: frame.controlWord.token}
+	item := e.waitItemsTake(&key)
+	if item == nil {
+		return
 	}
-}
 
-// dealRstFrame 处理复位连接帧
-// 返回true表示节点符合条件
-func dealRstFrame(protocol int, pipe uint64, srcIA uint64, frame *tFrame, node *list.Element) bool {
-	item := node.Value.(*tWaitItem)
-	if item.protocol != protocol || item.pipe != pipe || item.dstIA != srcIA || item.rid != frame.controlWord.rid ||
-		item.token != frame.controlWord.token {
-		return false
-	}
-	err := int(frame.payload[0])
+	// 错误码最高位是复位标志
+	err := int(frame.payload[0] & 0x7f)
 	logWarn("deal rst frame.token:%d result:0x%x", item.token, err)
-	waitItems.Remove(node)
+	if err == SystemErrorWrongBlockOffset && item.isBlock && e.blockTxIsExtFirstFrame(&key) {
+		// 不支持扩展块传输的对端收到首帧时回复偏移地址错误
+		logWarn("peer does not support extended block transfer.token:%d", item.token)
+		err = SystemErrorParamInvalid
+		item.resp.cause = errBlockExtNotSupported
+	}
 	item.resp.Error = err
+	item.resp.isRemote = true
 	item.end <- true
-	return true
 }